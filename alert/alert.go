@@ -0,0 +1,115 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+type Kind string
+
+const (
+	KindDeadLetter  Kind = "dead_letter"  // a notification used up its retry budget
+	KindFailureRate Kind = "failure_rate" // most notifications of a merchant are failing
+	KindQuarantine  Kind = "quarantine"   // a paid trade does not match its submit
+)
+
+// Order is an order affected by an alert
+type Order struct {
+	TradeNo    string `json:"trade_no"`
+	OutTradeNo string `json:"out_trade_no"`
+	JobID      string `json:"job_id"`
+	Attempts   int    `json:"attempts"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// Event is an alert about merchant notifications
+type Event struct {
+	Kind    Kind      `json:"kind"`
+	Pid     int       `json:"pid"`
+	Summary string    `json:"summary"`
+	Orders  []Order   `json:"orders"`
+	At      time.Time `json:"at"`
+}
+
+// Text renders the event for humans
+func (e *Event) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", e.Summary)
+	fmt.Fprintf(&b, "Merchant: %d\nTime: %s\n\n", e.Pid, e.At.Format(time.RFC3339))
+	for _, o := range e.Orders {
+		fmt.Fprintf(&b, "- out_trade_no=%s trade_no=%s job=%s attempts=%d", o.OutTradeNo, o.TradeNo, o.JobID, o.Attempts)
+		if o.LastError != "" {
+			fmt.Fprintf(&b, " error=%q", o.LastError)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Sink delivers alerts to operators
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, e *Event) error
+}
+
+var (
+	sinksMu sync.RWMutex
+	sinks   []Sink
+)
+
+// SetupSinks creates the alert sinks enabled in the configuration
+func SetupSinks() {
+	var enabled []Sink
+	if u := viper.GetString("alert.webhook_url"); u != "" {
+		enabled = append(enabled, NewWebhookSink(u))
+	}
+	if addr := viper.GetString("alert.smtp.addr"); addr != "" {
+		enabled = append(enabled, &SMTPSink{
+			Addr:     addr,
+			From:     viper.GetString("alert.smtp.from"),
+			To:       viper.GetStringSlice("alert.smtp.to"),
+			Username: viper.GetString("alert.smtp.username"),
+			Password: viper.GetString("alert.smtp.password"),
+		})
+	}
+
+	sinksMu.Lock()
+	sinks = enabled
+	sinksMu.Unlock()
+
+	log.Info().Int("sinks", len(enabled)).Msg("Alert sinks set up")
+}
+
+// Fire sends the event to every sink in the background. Failing sinks are
+// logged, there is nobody else to tell.
+func Fire(e *Event) {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+
+	log.Warn().
+		Str("kind", string(e.Kind)).
+		Int("pid", e.Pid).
+		Int("orders", len(e.Orders)).
+		Msg(e.Summary)
+
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+
+	for _, s := range sinks {
+		go func(s Sink) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			if err := s.Send(ctx, e); err != nil {
+				log.Error().Err(err).Str("sink", s.Name()).Str("kind", string(e.Kind)).Msg("Failed to send alert")
+			}
+		}(s)
+	}
+}
@@ -0,0 +1,70 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPSink mails events through an SMTP server. Authentication is only used
+// when a username is set.
+type SMTPSink struct {
+	Addr     string // host:port
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+func (s *SMTPSink) Name() string {
+	return "smtp"
+}
+
+func (s *SMTPSink) Send(ctx context.Context, e *Event) error {
+	if s.From == "" || len(s.To) == 0 {
+		return errors.New("smtp sender or recipients are not configured")
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject(e))
+	fmt.Fprintf(&msg, "Date: %s\r\n", e.At.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(e.Text(), "\n", "\r\n"))
+
+	// net/smtp takes no context, so give up waiting instead
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Addr, auth, s.From, s.To, []byte(msg.String()))
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// subject renders the Subject header of an event. The summary carries order
+// numbers chosen by merchants, so line breaks must not start new headers.
+func subject(e *Event) string {
+	s := strings.NewReplacer("\r", " ", "\n", " ").Replace("[epay-fwd] " + e.Summary)
+	return mime.QEncoding.Encode("utf-8", s)
+}
@@ -0,0 +1,127 @@
+package alert
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts one connection on a local port, speaks just enough SMTP
+// for net/smtp and hands over the mail data it receives
+func fakeSMTP(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	msgs := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+
+			verb, _, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250 localhost")
+			case "DATA":
+				tp.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				msgs <- string(data)
+				tp.PrintfLine("250 OK")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("250 OK")
+			}
+		}
+	}()
+
+	return ln.Addr().String(), msgs
+}
+
+func TestSMTPSink(t *testing.T) {
+	addr, msgs := fakeSMTP(t)
+	sink := &SMTPSink{
+		Addr: addr,
+		From: "epay-fwd@example.com",
+		To:   []string{"ops@example.com", "oncall@example.com"},
+	}
+
+	// out_trade_no is up to the merchant, line breaks included
+	e := &Event{
+		Kind:    KindDeadLetter,
+		Pid:     1001,
+		Summary: "Notification of order 订单-1\r\nBcc: victim@example.com to merchant 1001 was dead-lettered",
+		Orders:  []Order{{TradeNo: "T1", OutTradeNo: "订单-1", JobID: "job-1", Attempts: 8, LastError: "timeout"}},
+		At:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := sink.Send(context.Background(), e); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	var data string
+	select {
+	case data = <-msgs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse mail: %v", err)
+	}
+	if bcc := msg.Header.Get("Bcc"); bcc != "" {
+		t.Errorf("summary injected a Bcc header: %q", bcc)
+	}
+	if to := msg.Header.Get("To"); to != "ops@example.com, oncall@example.com" {
+		t.Errorf("To = %q", to)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("failed to decode subject: %v", err)
+	}
+	want := "[epay-fwd] Notification of order 订单-1  Bcc: victim@example.com to merchant 1001 was dead-lettered"
+	if subject != want {
+		t.Errorf("Subject = %q, want %q", subject, want)
+	}
+
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatalf("failed to read mail body: %v", err)
+	}
+	if !strings.Contains(string(body), "job=job-1 attempts=8") {
+		t.Errorf("body does not list the order:\n%s", body)
+	}
+}
+
+func TestSMTPSinkNotConfigured(t *testing.T) {
+	sink := &SMTPSink{Addr: "127.0.0.1:25", From: "epay-fwd@example.com"}
+	if err := sink.Send(context.Background(), &Event{Summary: "test"}); err == nil {
+		t.Error("Send() without recipients succeeded")
+	}
+}
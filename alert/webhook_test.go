@@ -0,0 +1,60 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookSink(t *testing.T) {
+	received := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+
+		var e Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("failed to decode event: %v", err)
+		}
+		received <- e
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	e := &Event{
+		Kind:    KindFailureRate,
+		Pid:     1001,
+		Summary: "Merchant 1001 failed 4 of 5 notifications in the last 10m0s",
+		Orders:  []Order{{TradeNo: "T1", OutTradeNo: "O1", JobID: "job-1", Attempts: 2, LastError: "timeout"}},
+		At:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := NewWebhookSink(srv.URL).Send(context.Background(), e); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	got := <-received
+	if got.Kind != e.Kind || got.Pid != e.Pid || got.Summary != e.Summary || !got.At.Equal(e.At) {
+		t.Errorf("received %+v, want %+v", got, *e)
+	}
+	if len(got.Orders) != 1 || got.Orders[0] != e.Orders[0] {
+		t.Errorf("received orders %+v, want %+v", got.Orders, e.Orders)
+	}
+}
+
+func TestWebhookSinkFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	if err := NewWebhookSink(srv.URL).Send(context.Background(), &Event{Summary: "test"}); err == nil {
+		t.Error("Send() succeeded against a failing webhook")
+	}
+}
@@ -0,0 +1,326 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/notify"
+	"github.com/yiffyi/epay-fwd/store"
+)
+
+// SetupAdminEndpoints registers the operator endpoints, authenticated with
+// the admin.token bearer token. They are disabled while no token is set.
+func SetupAdminEndpoints(g *echo.Group) {
+	log.Info().Msg("Setting up admin endpoints")
+	g.Use(middleware.KeyAuth(validateAdminToken))
+	g.POST("/notify/resend", HandleAdminResendNotify)
+	g.GET("/notify/log", HandleAdminNotifyLog)
+	g.GET("/notify/hosts", HandleAdminNotifyHosts)
+	g.GET("/orders", HandleAdminOrders)
+}
+
+const adminOrdersLimit = 200
+
+func validateAdminToken(key string, c echo.Context) (bool, error) {
+	token := viper.GetString("admin.token")
+	if token == "" {
+		log.Warn().Str("remote_ip", c.RealIP()).Msg("Rejected admin request, admin token is not configured")
+		return false, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key), []byte(token)) != 1 {
+		log.Warn().Str("remote_ip", c.RealIP()).Msg("Rejected admin request with invalid token")
+		return false, nil
+	}
+	return true, nil
+}
+
+// AdminResendRequest selects the notifications to send again: that of a
+// single order by trade_no, or by pid and out_trade_no, or every notification
+// created in [from, to) that was not delivered. Quarantined orders are only
+// resent with release, which marks them paid.
+type AdminResendRequest struct {
+	Env        string `json:"env,omitempty" form:"env"` // environment of a single order if not the stored one
+	Pid        int    `json:"pid,omitempty" form:"pid"` // merchant of out_trade_no
+	TradeNo    string `json:"trade_no,omitempty" form:"trade_no"`
+	OutTradeNo string `json:"out_trade_no,omitempty" form:"out_trade_no"`
+	From       string `json:"from,omitempty" form:"from"` // RFC 3339
+	To         string `json:"to,omitempty" form:"to"`     // RFC 3339
+	DryRun     bool   `json:"dry_run,omitempty" form:"dry_run"`
+	Release    bool   `json:"release,omitempty" form:"release"` // forward quarantined orders after review
+}
+
+type AdminResendResult struct {
+	Pid        int    `json:"pid,omitempty"`
+	TradeNo    string `json:"trade_no,omitempty"`
+	OutTradeNo string `json:"out_trade_no,omitempty"`
+	URL        string `json:"url,omitempty"`    // signed notify URL
+	JobID      string `json:"job_id,omitempty"` // empty on dry runs
+	Error      string `json:"error,omitempty"`
+}
+
+type AdminResendResponse struct {
+	DryRun  bool                `json:"dry_run"`
+	Results []AdminResendResult `json:"results"`
+}
+
+// HandleAdminResendNotify hands notifications to the notify dispatcher again.
+// A single order gets its payment notification rebuilt from its Alipay trade;
+// undelivered notifications are resent as they were, refunds and closes
+// included. Either is signed again with the current keys.
+func HandleAdminResendNotify(c echo.Context) error {
+	var req AdminResendRequest
+	if err := c.Bind(&req); err != nil {
+		log.Error().Err(err).Msg("Failed to bind request body to AdminResendRequest")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	resp := AdminResendResponse{DryRun: req.DryRun}
+
+	switch {
+	case req.TradeNo != "" || req.OutTradeNo != "":
+		log.Info().Bool("dry_run", req.DryRun).Msg("Handling admin notify resend request of one order")
+		resp.Results = append(resp.Results, resendNotify(ctx, req.Env, req.Pid, req.TradeNo, req.OutTradeNo, req.DryRun, req.Release))
+
+	case req.From != "" && req.To != "":
+		from, err := time.Parse(time.RFC3339, req.From)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid from")
+		}
+		to, err := time.Parse(time.RFC3339, req.To)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid to")
+		}
+
+		jobs, err := notify.Undelivered(from, to)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to list undelivered notify jobs")
+			return err
+		}
+
+		log.Info().Int("jobs", len(jobs)).Bool("dry_run", req.DryRun).Msg("Handling admin notify resend request")
+		resp.Results = make([]AdminResendResult, 0, len(jobs))
+		for _, job := range jobs {
+			resp.Results = append(resp.Results, resendJob(ctx, job, req.DryRun, req.Release))
+		}
+
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "trade_no, out_trade_no or from and to are required")
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// resendNotify rebuilds the payment notification of one order and, unless
+// dryRun, enqueues it for delivery. Quarantined orders need release.
+func resendNotify(ctx context.Context, env string, pid int, tradeNo, outTradeNo string, dryRun, release bool) AdminResendResult {
+	job, err := rebuildNotifyJob(ctx, env, pid, tradeNo, outTradeNo)
+	if err != nil {
+		log.Error().Err(err).Str("trade_no", tradeNo).Str("out_trade_no", outTradeNo).Msg("Failed to rebuild merchant notification")
+		return AdminResendResult{Pid: pid, TradeNo: tradeNo, OutTradeNo: outTradeNo, Error: err.Error()}
+	}
+
+	return enqueueResend(ctx, job, dryRun, release)
+}
+
+// resendJob sends an undelivered notification again as a new job, with its
+// own notify_type and parameters
+func resendJob(ctx context.Context, job *notify.Job, dryRun, release bool) AdminResendResult {
+	return enqueueResend(ctx, &notify.Job{
+		Pid:         job.Pid,
+		TradeNo:     job.TradeNo,
+		OutTradeNo:  job.OutTradeNo,
+		TradeStatus: job.TradeStatus,
+		Env:         job.Env,
+		NotifyUrl:   job.NotifyUrl,
+		Version:     job.Version,
+		Params:      job.Params,
+	}, dryRun, release)
+}
+
+// enqueueResend enqueues a resent notification unless dryRun. Quarantined
+// orders need release.
+func enqueueResend(ctx context.Context, job *notify.Job, dryRun, release bool) AdminResendResult {
+	result := AdminResendResult{Pid: job.Pid, TradeNo: job.TradeNo, OutTradeNo: job.OutTradeNo}
+
+	var err error
+	if result.URL, err = signedNotifyURL(job); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	order, err := findOrder(ctx, job.Pid, job.OutTradeNo)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	held := order != nil && order.Status == store.OrderQuarantined
+	if held && !release {
+		result.Error = "order is quarantined: " + order.QuarantineReason
+		return result
+	}
+
+	if dryRun {
+		return result
+	}
+
+	if held {
+		_, err := store.Orders().UpdateOrder(ctx, order.Pid, order.OutTradeNo, store.OrderUpdate{
+			Status:  store.OrderPaid,
+			PaidAt:  time.Now(),
+			Release: true,
+			Source:  "admin_release",
+		})
+		if err != nil {
+			log.Error().Err(err).Str("out_trade_no", order.OutTradeNo).Msg("Failed to release quarantined order")
+			result.Error = err.Error()
+			return result
+		}
+		log.Warn().Int("pid", order.Pid).Str("out_trade_no", order.OutTradeNo).Msg("Released quarantined order")
+	}
+
+	if err := notify.Enqueue(job); err != nil {
+		log.Error().Err(err).Str("trade_no", job.TradeNo).Msg("Failed to enqueue resent merchant notification")
+		result.Error = err.Error()
+		return result
+	}
+
+	log.Info().
+		Str("job_id", job.ID).
+		Int("pid", job.Pid).
+		Str("out_trade_no", job.OutTradeNo).
+		Str("notify_type", job.Params.Get("notify_type")).
+		Msg("Resending merchant notification")
+
+	result.JobID = job.ID
+	return result
+}
+
+// rebuildNotifyJob builds a notify job for a paid order from its Alipay trade.
+// The trade is looked up in env, else in the environment the order was created
+// in, else in epay.default_env.
+func rebuildNotifyJob(ctx context.Context, env string, pid int, tradeNo, outTradeNo string) (*notify.Job, error) {
+	query, order, err := alipayTradeQuery(ctx, pid, tradeNo, outTradeNo)
+	if err != nil {
+		return nil, err
+	}
+
+	if env == "" {
+		env = orderEnv(order, viper.GetString("epay.default_env"))
+	}
+	client, err := newAlipayClientForEnv(env)
+	if err != nil {
+		return nil, err
+	}
+
+	trade, err := client.TradeQuery(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query alipay trade: %w", err)
+	}
+	if trade.Code.IsFailure() {
+		return nil, fmt.Errorf("alipay trade query failed: %s", trade.SubMsg)
+	}
+	if !isTradePaid(trade.TradeStatus) {
+		return nil, errors.New("order is not paid")
+	}
+
+	carrier, _, err := tradeCarrier(ctx, trade.OutTradeNo, trade.PassbackParams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the order of the trade: %w", err)
+	}
+	carrier.Env = env
+
+	tradeStatus := mapTradeStatus(carrier.Pid, string(trade.TradeStatus))
+	if tradeStatus == "" {
+		return nil, fmt.Errorf("trade status %s is not forwarded", trade.TradeStatus)
+	}
+
+	values := buildEpayNotifyValues(tradeNotification(trade), carrier, tradeStatus, "")
+
+	tradeNo, outTradeNo = carrier.OrderNos(trade.TradeNo, trade.OutTradeNo)
+	return &notify.Job{
+		Pid:         carrier.Pid,
+		TradeNo:     tradeNo,
+		OutTradeNo:  outTradeNo,
+		TradeStatus: tradeStatus,
+		Env:         env,
+		NotifyUrl:   carrier.NotifyUrl,
+		Version:     carrier.Version,
+		Params:      values,
+	}, nil
+}
+
+// signedNotifyURL returns the notify URL of a job as it would be delivered now
+func signedNotifyURL(job *notify.Job) (string, error) {
+	params, err := SignNotifyJob(job)
+	if err != nil {
+		return "", err
+	}
+
+	signed := *job
+	signed.Params = params
+	return signed.URL()
+}
+
+type AdminNotifyHostsResponse struct {
+	Hosts []notify.HostStatus `json:"hosts"`
+}
+
+// HandleAdminNotifyHosts shows the concurrency and circuit breaker state of
+// merchant hosts
+func HandleAdminNotifyHosts(c echo.Context) error {
+	hosts := notify.Hosts()
+	if hosts == nil {
+		hosts = []notify.HostStatus{}
+	}
+	return c.JSON(http.StatusOK, AdminNotifyHostsResponse{Hosts: hosts})
+}
+
+type AdminOrdersResponse struct {
+	Orders []*store.Order `json:"orders"`
+}
+
+// HandleAdminOrders lists stored orders, newest first, filtered by the pid and
+// status query parameters. status=quarantined lists the orders held for review.
+func HandleAdminOrders(c echo.Context) error {
+	filter := store.OrderFilter{
+		Status: store.OrderStatus(c.QueryParam("status")),
+		Limit:  adminOrdersLimit,
+	}
+
+	if s := c.QueryParam("pid"); s != "" {
+		pid, err := strconv.Atoi(s)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid pid")
+		}
+		filter.Pid = pid
+	}
+	if s := c.QueryParam("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
+		}
+		filter.Limit = limit
+	}
+
+	orders, err := store.Orders().ListOrders(c.Request().Context(), filter)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list orders")
+		return err
+	}
+	if orders == nil {
+		orders = []*store.Order{}
+	}
+
+	return c.JSON(http.StatusOK, AdminOrdersResponse{Orders: orders})
+}
@@ -1,7 +1,7 @@
 package api
 
 import (
-	"encoding/base64"
+	"errors"
 	"net/http"
 	"net/url"
 
@@ -10,45 +10,130 @@ import (
 	"github.com/smartwalle/alipay/v3"
 	"github.com/spf13/viper"
 	"github.com/yiffyi/epay-fwd/epay"
-	"github.com/yiffyi/epay-fwd/sec"
+	"github.com/yiffyi/epay-fwd/notify"
+	"github.com/yiffyi/epay-fwd/store"
 )
 
 func SetupAlipayEndpoints(g *echo.Group) {
 	log.Info().Msg("Setting up Alipay endpoints")
 	g.POST("/notify", HandleAlipayNotify)
-	// g.POST("/return", HandleAlipayReturn)
+	g.GET("/return/:token", HandleAlipayReturn)
 }
 
+// alipayGateway replaces the Alipay gateway of both environments if set, so
+// that tests can stand in for Alipay
+var alipayGateway string
+
+// newAlipayClient creates an Alipay client for the given environment with the
+// Alipay public key loaded, so that responses and notifications can be verified
+func newAlipayClient(isProd bool) (*alipay.Client, error) {
+	var opts []alipay.OptionFunc
+	if alipayGateway != "" {
+		opts = append(opts, alipay.WithSandboxGateway(alipayGateway), alipay.WithProductionGateway(alipayGateway))
+	}
+
+	client, err := alipay.New(viper.GetString("alipay.app_id"), viper.GetString("alipay.app_private_key"), isProd, opts...)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create Alipay client")
+		return nil, err
+	}
+
+	if err := client.LoadAliPayPublicKey(viper.GetString("alipay.server_public_key")); err != nil {
+		log.Error().Err(err).Msg("Failed to load Alipay public key")
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// HandleAlipayReturn brings the buyer back from Alipay. It verifies Alipay's
+// signature and the order status, then redirects to the return_url of the
+// order named by the signed return token with epay-signed parameters. Nothing
+// but that return_url can be redirected to.
 func HandleAlipayReturn(c echo.Context) error {
 	log.Info().Msg("Handling Alipay return request")
 	values := c.QueryParams()
 
-	client, err := alipay.New(viper.GetString("alipay.app_id"), viper.GetString("alipay.app_private_key"), true)
+	client, err := newAlipayClient(true)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to create Alipay client")
 		return err
 	}
 
 	if err := client.VerifySign(values); err != nil {
 		log.Error().Err(err).Msg("Failed to verify Alipay signature")
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid alipay signature")
 	}
 
 	log.Debug().Msg("Alipay signature verified successfully")
 
-	urlBytes, err := base64.RawURLEncoding.DecodeString(c.Param("realUrl"))
+	// The token must belong to the trade Alipay returned from, not just any of ours
+	pid, alipayOutTradeNo, err := openReturnToken(c.Param("token"))
+	if err != nil || alipayOutTradeNo != values.Get("out_trade_no") {
+		log.Error().Err(err).Str("out_trade_no", values.Get("out_trade_no")).Msg("Failed to verify return token")
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid return token")
+	}
+
+	order, err := findTradeOrder(c.Request().Context(), pid, alipayOutTradeNo)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to decode URL from parameter")
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return err
+	}
+	if order == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "order not found")
 	}
 
-	redirectUrl := string(urlBytes)
-	log.Info().Str("redirect_url", redirectUrl).Msg("Redirecting user after Alipay return")
+	returnURL, err := url.Parse(order.ReturnUrl)
+	if err != nil || (returnURL.Scheme != "http" && returnURL.Scheme != "https") {
+		log.Error().Err(err).Str("return_url", order.ReturnUrl).Msg("Refusing to redirect to invalid return URL")
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid return url")
+	}
+
+	// Ask Alipay for the order status in the environment the order was created in
+	envClient, err := newAlipayClientForEnv(order.Env)
+	if err != nil {
+		return err
+	}
+
+	trade, err := envClient.TradeQuery(c.Request().Context(), alipay.TradeQuery{OutTradeNo: alipayOutTradeNo})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to query Alipay trade")
+		return err
+	}
+	if trade.Code.IsFailure() {
+		log.Error().Str("sub_code", trade.SubCode).Str("sub_msg", trade.SubMsg).Msg("Alipay trade query failed")
+		return echo.NewHTTPError(http.StatusNotFound, "order not found")
+	}
+	if !isTradePaid(trade.TradeStatus) {
+		log.Warn().Str("trade_no", trade.TradeNo).Str("trade_status", string(trade.TradeStatus)).Msg("Buyer returned for unpaid order")
+		return echo.NewHTTPError(http.StatusPaymentRequired, "order is not paid")
+	}
 
-	// TODO: no arbitrary redirect
-	// TODO: check and include order status
+	// Quarantined orders and trades not matching the submit are not paid for
+	// the merchant
+	if order.Status == store.OrderQuarantined {
+		log.Warn().Str("out_trade_no", order.OutTradeNo).Msg("Buyer returned for quarantined order")
+		return echo.NewHTTPError(http.StatusConflict, "order is held for review")
+	}
+	if err := checkOrder(tradeNotification(trade), order, ""); err != nil {
+		log.Error().Err(err).Str("out_trade_no", order.OutTradeNo).Msg("Buyer returned for trade not matching the order")
+		return echo.NewHTTPError(http.StatusConflict, "order is held for review")
+	}
 
-	return c.Redirect(http.StatusTemporaryRedirect, redirectUrl)
+	returnValues := buildEpayNotifyValues(tradeNotification(trade), orderCarrier(order), "TRADE_SUCCESS", "")
+	if err := signNotifyValues(returnValues, order.Pid, order.Version); err != nil {
+		return err
+	}
+
+	// Keep whatever query the merchant put in its return_url
+	query := returnURL.Query()
+	for k, v := range returnValues {
+		query[k] = v
+	}
+	returnURL.RawQuery = query.Encode()
+
+	redirectUrl := returnURL.String()
+	log.Info().Str("redirect_url", redirectUrl).Msg("Redirecting user after Alipay return")
+
+	return c.Redirect(http.StatusFound, redirectUrl)
 }
 
 func HandleAlipayNotify(c echo.Context) error {
@@ -60,38 +145,27 @@ func HandleAlipayNotify(c echo.Context) error {
 		return err
 	}
 
-	client, err := alipay.New(viper.GetString("alipay.app_id"), viper.GetString("alipay.app_private_key"), true)
+	client, err := newAlipayClient(true)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to create Alipay client")
 		return err
 	}
-	client.LoadAliPayPublicKey(viper.GetString("alipay.server_public_key"))
 
 	// DecodeNotification 内部已调用 VerifySign 方法验证签名
-	notify, err := client.DecodeNotification(values)
+	notification, err := client.DecodeNotification(values)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to decode Alipay notification")
 		return err
 	}
 
 	log.Debug().
-		Str("trade_no", notify.TradeNo).
-		Str("out_trade_no", notify.OutTradeNo).
-		Str("trade_status", string(notify.TradeStatus)).
-		Str("total_amount", notify.TotalAmount).
+		Str("trade_no", notification.TradeNo).
+		Str("out_trade_no", notification.OutTradeNo).
+		Str("trade_status", string(notification.TradeStatus)).
+		Str("total_amount", notification.TotalAmount).
 		Msg("Received Alipay notification")
 
-	tradeStatus := "UNKNOWN"
-	if notify.TradeStatus == "TRADE_SUCCESS" || notify.TradeStatus == "TRADE_FINISHED" {
-		tradeStatus = "TRADE_SUCCESS"
-	} else {
-		tradeStatus = string(notify.TradeStatus)
-	}
-	log.Debug().Str("normalized_trade_status", tradeStatus).Msg("Normalized trade status")
-
-	epayParamCarrier, err := epay.DecodeParamCarrier(notify.PassbackParams)
+	epayParamCarrier, order, err := tradeCarrier(c.Request().Context(), notification.OutTradeNo, notification.PassbackParams)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to decode param carrier from passback params")
 		return err
 	}
 
@@ -101,17 +175,133 @@ func HandleAlipayNotify(c echo.Context) error {
 		Str("param", epayParamCarrier.Param).
 		Msg("Decoded param carrier")
 
+	// Alipay knows the order by our trade_no, the merchant by its out_trade_no
+	_, outTradeNo := epayParamCarrier.OrderNos(notification.TradeNo, notification.OutTradeNo)
+
+	notifyType, statusKey := classifyNotification(notification)
+
+	// Whatever Alipay reports must match our app and what the merchant signed
+	if err := checkAlipayApp(notification); err != nil {
+		return quarantineNotification(c, epayParamCarrier, order, notification, err)
+	}
+	if order != nil {
+		if err := checkOrder(notification, order, notifyType); err != nil {
+			return quarantineNotification(c, epayParamCarrier, order, notification, err)
+		}
+		if order.Status == store.OrderQuarantined {
+			log.Warn().Str("out_trade_no", order.OutTradeNo).Msg("Holding Alipay notification of quarantined order")
+			return c.String(http.StatusOK, "success")
+		}
+	}
+
+	// Returning an error makes Alipay notify again, so the order catches up
+	if err := updateOrder(c.Request().Context(), order, notification, notifyType); err != nil {
+		return err
+	}
+
+	tradeStatus := mapTradeStatus(epayParamCarrier.Pid, statusKey)
+	log.Debug().
+		Str("notify_type", notifyType).
+		Str("status_key", statusKey).
+		Str("mapped_trade_status", tradeStatus).
+		Msg("Mapped trade status")
+
+	if tradeStatus == "" {
+		log.Info().
+			Str("out_trade_no", outTradeNo).
+			Str("status_key", statusKey).
+			Msg("Acknowledging Alipay notification without forwarding it")
+		return c.String(http.StatusOK, "success")
+	}
+
+	// Persist the notification for the merchant before acknowledging Alipay;
+	// delivery happens in the background with retries
+	job := newNotifyJob(notification, epayParamCarrier, tradeStatus, notifyType)
+	if err := notify.Enqueue(job); errors.Is(err, notify.ErrJobExists) {
+		return answerDuplicateAlipayNotify(c, job.ID, notification.NotifyId)
+	} else if err != nil {
+		log.Error().Err(err).Str("out_trade_no", outTradeNo).Msg("Failed to enqueue merchant notification")
+		return err
+	}
+
+	log.Info().
+		Str("job_id", job.ID).
+		Str("out_trade_no", outTradeNo).
+		Msg("Acknowledging Alipay notification")
+
+	return c.String(http.StatusOK, "success")
+}
+
+// newNotifyJob builds the job telling the merchant what an Alipay notification
+// reports. Each state change gets one job, so that it reaches the merchant
+// once however often Alipay repeats it.
+func newNotifyJob(notification *alipay.Notification, carrier *epay.ParamCarrier, tradeStatus string, notifyType string) *notify.Job {
+	tradeNo, outTradeNo := carrier.OrderNos(notification.TradeNo, notification.OutTradeNo)
+	return &notify.Job{
+		ID:          notify.TransitionID(tradeNo, transition(notifyType, tradeStatus, notification)),
+		Pid:         carrier.Pid,
+		TradeNo:     tradeNo,
+		OutTradeNo:  outTradeNo,
+		TradeStatus: tradeStatus,
+		NotifyID:    notification.NotifyId,
+		Env:         carrier.Env,
+		NotifyUrl:   carrier.NotifyUrl,
+		Version:     carrier.Version,
+		Params:      buildEpayNotifyValues(notification, carrier, tradeStatus, notifyType),
+	}
+}
+
+// answerDuplicateAlipayNotify acknowledges a notification whose state change
+// has already been accepted, without notifying the merchant again
+func answerDuplicateAlipayNotify(c echo.Context, jobID, notifyID string) error {
+	job, err := notify.Get(jobID)
+	if err != nil {
+		log.Error().Err(err).Str("job_id", jobID).Msg("Failed to load notify job of duplicate Alipay notification")
+		return err
+	}
+
+	log.Info().
+		Str("job_id", job.ID).
+		Str("notify_id", notifyID).
+		Str("first_notify_id", job.NotifyID).
+		Str("out_trade_no", job.OutTradeNo).
+		Str("state", string(job.State)).
+		Msg("Acknowledging duplicate Alipay notification")
+
+	return c.String(http.StatusOK, "success")
+}
+
+// buildEpayNotifyValues builds the notification for the merchant, in the
+// protocol version the order was submitted with. Refunds and closes are
+// labeled with their notifyType; payments have none. It is signed by
+// signNotifyValues right before it is sent.
+func buildEpayNotifyValues(notification *alipay.Notification, carrier *epay.ParamCarrier, tradeStatus string, notifyType string) url.Values {
+	if carrier.Version == 2 {
+		return buildEpayV2NotifyValues(notification, carrier, tradeStatus, notifyType)
+	}
+
+	tradeNo, outTradeNo := carrier.OrderNos(notification.TradeNo, notification.OutTradeNo)
+
 	// Create the EpayNotifyRequest
 	epayNotify := epay.EpayNotifyRequest{
-		Pid:         epayParamCarrier.Pid,
-		TradeNo:     notify.TradeNo,
-		OutTradeNo:  notify.OutTradeNo,
+		Pid:         carrier.Pid,
+		TradeNo:     tradeNo,
+		OutTradeNo:  outTradeNo,
 		Type:        "alipay",
-		Name:        notify.Subject,
-		Money:       notify.TotalAmount,
+		Name:        notification.Subject,
+		Money:       notification.TotalAmount,
 		TradeStatus: tradeStatus,
-		Param:       epayParamCarrier.Param,
-		SignType:    "MD5",
+		Param:       carrier.Param,
+		NotifyType:  notifyType,
+		SignType:    carrier.SignType,
+	}
+	if notifyType == notifyTypeRefund {
+		epayNotify.RefundMoney = notification.RefundFee
+		epayNotify.OutRefundNo = notification.OutBizNo
+		epayNotify.RefundTime = notification.GmtRefund
+	}
+	if epayNotify.SignType == "" {
+		epayNotify.SignType = "MD5"
 	}
 
 	log.Debug().
@@ -122,50 +312,85 @@ func HandleAlipayNotify(c echo.Context) error {
 		Str("name", epayNotify.Name).
 		Str("money", epayNotify.Money).
 		Str("trade_status", epayNotify.TradeStatus).
-		Msg("Created Epay notify request")
+		Str("notify_type", epayNotify.NotifyType).
+		Msg("Created Epay notification request")
 
-	// Calculate the sign
-	merchantKey := sec.DeriveMyEpayKey(epayParamCarrier.Pid, viper.GetString("epay.fwd_secret"))
-	epayNotify.Sign, err = epay.CalculateSign(&epayNotify, merchantKey)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to calculate sign for Epay notify request")
-		return err
-	}
+	values := epayNotify.ToURLValues()
+	values.Del("sign")
+	return values
+}
 
-	// Parse the base URL
-	notifyURL, err := url.Parse(epayParamCarrier.NotifyUrl)
-	if err != nil {
-		log.Error().Err(err).Str("notify_url", epayParamCarrier.NotifyUrl).Msg("Failed to parse notify URL")
-		return err
+// buildEpayV2NotifyValues builds a V2 notification, to be stamped and signed
+// with the platform private key
+func buildEpayV2NotifyValues(notification *alipay.Notification, carrier *epay.ParamCarrier, tradeStatus string, notifyType string) url.Values {
+	tradeNo, outTradeNo := carrier.OrderNos(notification.TradeNo, notification.OutTradeNo)
+
+	epayNotify := epay.EpayV2NotifyRequest{
+		Pid:         carrier.Pid,
+		TradeNo:     tradeNo,
+		OutTradeNo:  outTradeNo,
+		ApiTradeNo:  notification.TradeNo,
+		Type:        "alipay",
+		TradeStatus: tradeStatus,
+		Addtime:     notification.GmtCreate,
+		Endtime:     notification.GmtPayment,
+		Name:        notification.Subject,
+		Money:       notification.TotalAmount,
+		Param:       carrier.Param,
+		Buyer:       notification.BuyerLogonId,
+		NotifyType:  notifyType,
+		SignType:    epayV2SignType,
+	}
+	if notifyType == notifyTypeRefund {
+		epayNotify.RefundMoney = notification.RefundFee
+		epayNotify.OutRefundNo = notification.OutBizNo
+		epayNotify.RefundTime = notification.GmtRefund
 	}
 
-	// Set the query parameters
-	notifyURL.RawQuery = epayNotify.ToURLValues().Encode()
+	log.Debug().
+		Int("pid", epayNotify.Pid).
+		Str("trade_no", epayNotify.TradeNo).
+		Str("out_trade_no", epayNotify.OutTradeNo).
+		Str("money", epayNotify.Money).
+		Str("trade_status", epayNotify.TradeStatus).
+		Str("notify_type", epayNotify.NotifyType).
+		Msg("Created Epay V2 notification request")
 
-	fullNotifyURL := notifyURL.String()
-	log.Info().Str("notify_url", fullNotifyURL).Msg("Sending notification to merchant")
+	return epayNotify.ToURLValues()
+}
 
-	// Send the GET request
-	resp, err := http.Get(fullNotifyURL)
-	if err != nil {
-		log.Error().Err(err).Str("notify_url", fullNotifyURL).Msg("Failed to send GET request to notify URL")
-		return err
+// signNotifyValues signs notification parameters for sending them now. V1
+// ones are signed with the scheme the merchant submitted with. V2 ones are
+// stamped with the current time and signed with the platform private key, as
+// merchants reject stale timestamps.
+func signNotifyValues(values url.Values, pid int, version int) error {
+	if version == 2 {
+		values.Set("timestamp", epay.NewTimestamp())
+		if err := signEpayV2Values(values); err != nil {
+			log.Error().Err(err).Msg("Failed to calculate sign for Epay V2 notification request")
+			return err
+		}
+		return nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Error().
-			Int("status_code", resp.StatusCode).
-			Str("notify_url", fullNotifyURL).
-			Msg("Received non-OK response from merchant notify URL")
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to send notification")
+	// Calculate the sign with the scheme the merchant submitted with
+	if err := epay.SignValues(values, merchantSignKey(pid)); err != nil {
+		log.Error().Err(err).Msg("Failed to calculate sign for Epay notification request")
+		return err
 	}
+	return nil
+}
 
-	log.Info().
-		Int("status_code", resp.StatusCode).
-		Str("out_trade_no", notify.OutTradeNo).
-		Msg("Successfully forwarded notification to merchant")
+// SignNotifyJob returns the parameters of a notify job signed with the
+// current keys, for the notify dispatcher to deliver
+func SignNotifyJob(job *notify.Job) (url.Values, error) {
+	values := make(url.Values, len(job.Params))
+	for k, v := range job.Params {
+		values[k] = append([]string(nil), v...)
+	}
 
-	// alipay.ACKNotification(c.Response().Writer)
-	return c.Stream(resp.StatusCode, resp.Header.Get("Content-Type"), resp.Body)
+	if err := signNotifyValues(values, job.Pid, job.Version); err != nil {
+		return nil, err
+	}
+	return values, nil
 }
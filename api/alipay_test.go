@@ -0,0 +1,321 @@
+package api
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/epay"
+	"github.com/yiffyi/epay-fwd/misc"
+	"github.com/yiffyi/epay-fwd/notify"
+	"github.com/yiffyi/epay-fwd/store"
+)
+
+const testAppID = "2021000000000001"
+
+// testAlipay stands in for Alipay, signing notifications with its own key
+type testAlipay struct {
+	key *rsa.PrivateKey
+}
+
+// setupTestAlipay configures an Alipay app trusting a key of the test's own
+func setupTestAlipay(t *testing.T) *testAlipay {
+	t.Helper()
+
+	appKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	alipayKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	alipayPub, err := x509.MarshalPKIXPublicKey(&alipayKey.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey() error = %v", err)
+	}
+
+	viper.Set("alipay.app_id", testAppID)
+	viper.Set("alipay.app_private_key", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(appKey)})))
+	viper.Set("alipay.server_public_key", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: alipayPub})))
+	viper.Set("alipay.seller_id", "")
+	viper.Set("epay.fwd_secret", "test-secret")
+	return &testAlipay{key: alipayKey}
+}
+
+// notify posts a notification signed like Alipay does to HandleAlipayNotify
+func (a *testAlipay) notify(t *testing.T, values url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	values.Set("app_id", testAppID)
+	values.Set("sign_type", "RSA2")
+
+	var pairs []string
+	for k, vs := range values {
+		if k == "sign" || k == "sign_type" {
+			continue
+		}
+		for _, v := range vs {
+			pairs = append(pairs, k+"="+v)
+		}
+	}
+	sort.Strings(pairs)
+	digest := sha256.Sum256([]byte(strings.Join(pairs, "&")))
+	sign, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("SignPKCS1v15() error = %v", err)
+	}
+	values.Set("sign", base64.StdEncoding.EncodeToString(sign))
+
+	req := httptest.NewRequest(http.MethodPost, "/alipay/notify", strings.NewReader(values.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+
+	e := echo.New()
+	c := e.NewContext(req, rec)
+	if err := HandleAlipayNotify(c); err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+	return rec
+}
+
+// testGateway stands in for the Alipay gateway, answering each API method
+// with what its handler returns for the biz_content of the call
+type testGateway struct {
+	alipay *testAlipay
+
+	mu       sync.Mutex
+	handlers map[string]func(biz map[string]any) any
+	calls    []string
+}
+
+// serveGateway points the Alipay clients at a test gateway signing its
+// responses with the Alipay key
+func (a *testAlipay) serveGateway(t *testing.T) *testGateway {
+	t.Helper()
+
+	g := &testGateway{alipay: a, handlers: make(map[string]func(biz map[string]any) any)}
+	server := httptest.NewServer(http.HandlerFunc(g.serve))
+	t.Cleanup(server.Close)
+
+	alipayGateway = server.URL
+	t.Cleanup(func() { alipayGateway = "" })
+	return g
+}
+
+// handle answers calls of an API method such as alipay.trade.query
+func (g *testGateway) handle(method string, handler func(biz map[string]any) any) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.handlers[method] = handler
+}
+
+// called returns the API methods called so far
+func (g *testGateway) called() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.calls...)
+}
+
+func (g *testGateway) serve(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	method := r.Form.Get("method")
+	var biz map[string]any
+	json.Unmarshal([]byte(r.Form.Get("biz_content")), &biz)
+
+	g.mu.Lock()
+	g.calls = append(g.calls, method)
+	handler := g.handlers[method]
+	g.mu.Unlock()
+
+	if handler == nil {
+		http.Error(w, "unexpected call of "+method, http.StatusNotImplemented)
+		return
+	}
+
+	content, _ := json.Marshal(handler(biz))
+	digest := sha256.Sum256(content)
+	sign, _ := rsa.SignPKCS1v15(rand.Reader, g.alipay.key, crypto.SHA256, digest[:])
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"%s_response":%s,"sign":"%s"}`, strings.ReplaceAll(method, ".", "_"), content, base64.StdEncoding.EncodeToString(sign))
+}
+
+// testMerchant records the notifications a merchant receives
+type testMerchant struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	received []url.Values
+}
+
+func (m *testMerchant) notifications() []url.Values {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]url.Values(nil), m.received...)
+}
+
+// setupTestDispatcher starts the notify dispatcher on the test store, with
+// merchant 1001 acknowledging every notification at a local test server
+func setupTestDispatcher(t *testing.T) *testMerchant {
+	t.Helper()
+
+	m := &testMerchant{}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		m.mu.Lock()
+		m.received = append(m.received, r.Form)
+		m.mu.Unlock()
+		w.Write([]byte("success"))
+	}))
+	t.Cleanup(m.Close)
+
+	viper.Set("notify.retry_schedule", []string{"0s", "1h"})
+	viper.Set("notify.workers", 2)
+	viper.Set(misc.MerchantConfigKey(1001, "notify_allow"), []string{"127.0.0.1"})
+	if err := notify.SetupDispatcher(store.Orders(), SignNotifyJob); err != nil {
+		t.Fatalf("SetupDispatcher() error = %v", err)
+	}
+	return m
+}
+
+// createNotifyTestOrder stores an order of merchant 1001 notified at notifyURL
+func createNotifyTestOrder(t *testing.T, outTradeNo, notifyURL string) *store.Order {
+	t.Helper()
+
+	order := &store.Order{
+		Pid:        1001,
+		OutTradeNo: outTradeNo,
+		TradeNo:    "T" + outTradeNo,
+		Env:        "sandbox",
+		Type:       "alipay",
+		Name:       "VIP",
+		Money:      "1.00",
+		NotifyUrl:  notifyURL,
+		Param:      "extra",
+		PayMethod:  payMethodPage,
+		Version:    1,
+		Status:     store.OrderCreated,
+	}
+	if err := store.Orders().CreateOrder(t.Context(), order); err != nil {
+		t.Fatalf("CreateOrder() error = %v", err)
+	}
+	return order
+}
+
+// alipayNotification returns the parameters of an Alipay notification of order
+func alipayNotification(order *store.Order, notifyID string, tradeStatus string) url.Values {
+	return url.Values{
+		"notify_id":       {notifyID},
+		"notify_time":     {"2024-01-02 03:04:05"},
+		"notify_type":     {"trade_status_sync"},
+		"trade_no":        {"2024010222001400000001"},
+		"out_trade_no":    {order.TradeNo},
+		"trade_status":    {tradeStatus},
+		"total_amount":    {order.Money},
+		"subject":         {order.Name},
+		"passback_params": {"1001"},
+		"gmt_create":      {"2024-01-02 03:00:00"},
+		"gmt_payment":     {"2024-01-02 03:01:00"},
+	}
+}
+
+// waitForNotifications waits until the merchant has received n notifications
+func waitForNotifications(t *testing.T, m *testMerchant, n int) []url.Values {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		received := m.notifications()
+		if len(received) >= n {
+			return received
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("merchant received %d notifications, want %d", len(received), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAlipayNotifyOncePerTransition(t *testing.T) {
+	setupTestStore(t)
+	a := setupTestAlipay(t)
+	m := setupTestDispatcher(t)
+	order := createNotifyTestOrder(t, "O1", m.URL+"/notify.php")
+
+	refund := func(notifyID, outBizNo, refundFee string) url.Values {
+		values := alipayNotification(order, notifyID, "TRADE_SUCCESS")
+		values.Set("out_biz_no", outBizNo)
+		values.Set("refund_fee", refundFee)
+		values.Set("gmt_refund", "2024-01-03 03:04:05.000")
+		return values
+	}
+
+	steps := []struct {
+		name   string
+		values url.Values
+		want   int // notifications the merchant has received after the step
+	}{
+		{"paid", alipayNotification(order, "N1", "TRADE_SUCCESS"), 1},
+		{"paid again", alipayNotification(order, "N2", "TRADE_SUCCESS"), 1},
+		{"same notification again", alipayNotification(order, "N1", "TRADE_SUCCESS"), 1},
+		{"finished", alipayNotification(order, "N3", "TRADE_FINISHED"), 1},
+		{"refund", refund("N4", "R1", "0.40"), 2},
+		{"refund again", refund("N5", "R1", "0.40"), 2},
+		{"second refund", refund("N6", "R2", "0.60"), 3},
+	}
+
+	for _, step := range steps {
+		rec := a.notify(t, step.values)
+		if rec.Code != http.StatusOK || rec.Body.String() != "success" {
+			t.Fatalf("%s: Alipay was answered %d %s", step.name, rec.Code, rec.Body.String())
+		}
+
+		waitForNotifications(t, m, step.want)
+		// Give a duplicate the time it would need to be delivered
+		time.Sleep(50 * time.Millisecond)
+		if n := len(m.notifications()); n != step.want {
+			t.Fatalf("%s: merchant received %d notifications, want %d", step.name, n, step.want)
+		}
+	}
+
+	received := m.notifications()
+	for i, want := range []struct{ status, notifyType, outRefundNo string }{
+		{"TRADE_SUCCESS", "", ""},
+		{"TRADE_REFUND", notifyTypeRefund, "R1"},
+		{"TRADE_REFUND", notifyTypeRefund, "R2"},
+	} {
+		got := received[i]
+		if got.Get("trade_status") != want.status || got.Get("notify_type") != want.notifyType ||
+			got.Get("out_refund_no") != want.outRefundNo || got.Get("out_trade_no") != "O1" || got.Get("param") != "extra" {
+			t.Errorf("notification %d = %v", i+1, got)
+		}
+		if err := epay.NewEpaySignValidator(merchantSignKey(1001)).Validate(got); err != nil {
+			t.Errorf("notification %d is not signed for the merchant: %v", i+1, err)
+		}
+	}
+
+	stored, err := store.Orders().GetOrder(t.Context(), 1001, "O1")
+	if err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+	if stored.Status != store.OrderRefunded {
+		t.Errorf("order is %s, want %s", stored.Status, store.OrderRefunded)
+	}
+}
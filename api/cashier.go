@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/epay"
+	"github.com/yiffyi/epay-fwd/misc"
+	"github.com/yiffyi/epay-fwd/sec"
+	"github.com/yiffyi/epay-fwd/web"
+)
+
+// supportedPayTypes are the epay types this gateway can actually charge, with
+// the names shown in the cashier
+var supportedPayTypes = map[string]string{
+	"alipay": "支付宝",
+}
+
+// enabledPayTypes returns the epay types enabled for a merchant in an
+// environment: merchants.<pid>.types, else envs.<env>.types, else epay.types
+func enabledPayTypes(env string, pid int) []string {
+	for _, key := range []string{
+		misc.MerchantConfigKey(pid, "types"),
+		fmt.Sprintf("envs.%s.types", env),
+	} {
+		if viper.IsSet(key) {
+			return viper.GetStringSlice(key)
+		}
+	}
+	return viper.GetStringSlice("epay.types")
+}
+
+// availablePayTypes returns the enabled types that are also supported
+func availablePayTypes(env string, pid int) []web.PayType {
+	var types []web.PayType
+	for _, t := range enabledPayTypes(env, pid) {
+		if name, ok := supportedPayTypes[t]; ok {
+			types = append(types, web.PayType{Type: t, Name: name})
+		}
+	}
+	return types
+}
+
+// checkPayType rejects a type that is not available to the merchant, rather
+// than silently charging it through Alipay
+func checkPayType(env string, pid int, payType string) error {
+	if payType == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "type is required")
+	}
+
+	if _, ok := supportedPayTypes[payType]; !ok || !slices.Contains(enabledPayTypes(env, pid), payType) {
+		log.Warn().Str("env", env).Int("pid", pid).Str("type", payType).Msg("Rejected unsupported payment type")
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported payment type: %s", payType))
+	}
+	return nil
+}
+
+// renderCashier shows the cashier for a validated submit without a type. The
+// submission is carried in a signed token, so that the buyer's choice can
+// continue it without the merchant's sign, which does not cover the type.
+func renderCashier(c echo.Context, epayParam *epay.EpaySubmitRequest) error {
+	types := availablePayTypes(epayEnv(c), epayParam.Pid)
+	if len(types) == 0 {
+		log.Warn().Int("pid", epayParam.Pid).Msg("No payment type available for cashier")
+		return echo.NewHTTPError(http.StatusBadRequest, "no payment type available")
+	}
+
+	data, err := json.Marshal(epayParam)
+	if err != nil {
+		return err
+	}
+	token := sec.SignToken("cashier", base64.RawURLEncoding.EncodeToString(data), viper.GetString("epay.fwd_secret"))
+
+	log.Info().
+		Int("pid", epayParam.Pid).
+		Str("out_trade_no", epayParam.OutTradeNo).
+		Int("types", len(types)).
+		Msg("Showing cashier")
+
+	return c.Render(http.StatusOK, "cashier.html", web.CashierPage{
+		OutTradeNo: epayParam.OutTradeNo,
+		Name:       epayParam.Name,
+		Money:      epayParam.Money,
+		Token:      token,
+		Types:      types,
+	})
+}
+
+// HandleEpayCashier continues a submission from the cashier with the type the
+// buyer picked
+func HandleEpayCashier(c echo.Context) error {
+	encoded, err := sec.OpenToken("cashier", c.FormValue("token"), viper.GetString("epay.fwd_secret"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to verify cashier token")
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid cashier token")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid cashier token")
+	}
+
+	var epayParam epay.EpaySubmitRequest
+	if err := json.Unmarshal(data, &epayParam); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid cashier token")
+	}
+
+	epayParam.Type = c.FormValue("type")
+	log.Info().
+		Int("pid", epayParam.Pid).
+		Str("out_trade_no", epayParam.OutTradeNo).
+		Str("type", epayParam.Type).
+		Msg("Continuing submission from cashier")
+
+	return submitEpayPayment(c, &epayParam)
+}
@@ -1,21 +1,60 @@
 package api
 
 import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 	"github.com/smartwalle/alipay/v3"
 	"github.com/spf13/viper"
 	"github.com/yiffyi/epay-fwd/epay"
+	"github.com/yiffyi/epay-fwd/misc"
 	"github.com/yiffyi/epay-fwd/sec"
+	"github.com/yiffyi/epay-fwd/store"
+	"github.com/yiffyi/epay-fwd/web"
 )
 
 func SetupEpayEndpoints(g *echo.Group) {
 	log.Info().Msg("Setting up Epay endpoints")
-	g.POST("/:env/submit.php", HandleEpaySubmit)
+	setupEpayRoutes(g, "/:env")
+}
+
+// SetupEpayRootEndpoints serves the stock epay paths (/submit.php, /mapi.php,
+// /api.php, /api/pay/...) at the root of g, so that merchants only have to
+// change their base URL. The environment comes from epay.default_env.
+func SetupEpayRootEndpoints(g *echo.Group) {
+	log.Info().Str("env", viper.GetString("epay.default_env")).Msg("Setting up Epay root endpoints")
+	setupEpayRoutes(g, "")
+}
+
+func setupEpayRoutes(g *echo.Group, prefix string) {
+	g.GET(prefix+"/submit.php", HandleEpaySubmit)
+	g.POST(prefix+"/submit.php", HandleEpaySubmit)
+	g.POST(prefix+"/cashier.php", HandleEpayCashier)
+	g.POST(prefix+"/mapi.php", HandleEpayMapi)
+	g.GET(prefix+"/api.php", HandleEpayApi)
+	g.POST(prefix+"/api.php", HandleEpayApi)
+	g.POST(prefix+"/api/pay/create", HandleEpayV2Create)
+	g.POST(prefix+"/api/pay/query", HandleEpayV2Query)
+	g.POST(prefix+"/api/pay/refund", HandleEpayV2Refund)
+}
+
+// epayEnv returns the environment named in the request path, or the configured
+// default one for the root endpoints
+func epayEnv(c echo.Context) string {
+	if env := c.Param("env"); env != "" {
+		return env
+	}
+	return viper.GetString("epay.default_env")
 }
 
 func buildAlipayNotifyUrl() (string, error) {
@@ -32,100 +71,587 @@ func buildAlipayNotifyUrl() (string, error) {
 	return notifyUrl, nil
 }
 
-func HandleEpaySubmit(c echo.Context) error {
-	env := c.Param("env")
-	log.Info().Str("env", env).Msg("Handling Epay submit request")
+// buildAlipayReturnUrl builds the return_url handed to Alipay, which brings the
+// buyer back to HandleAlipayReturn with the signed return token
+func buildAlipayReturnUrl(token string) (string, error) {
+	base, err := url.Parse(viper.GetString("site_url"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to parse site URL")
+		return "", err
+	}
+
+	base.Path = "/alipay/return/" + token
+	return base.String(), nil
+}
+
+// buildReturnToken names the order the buyer returns from for
+// HandleAlipayReturn, by pid and the out_trade_no Alipay knows it by. It is
+// signed, so that it cannot be turned into an open redirect.
+func buildReturnToken(pid int, alipayOutTradeNo string) string {
+	return sec.SignToken("return", strconv.Itoa(pid)+":"+alipayOutTradeNo, viper.GetString("epay.fwd_secret"))
+}
+
+// openReturnToken verifies a token made by buildReturnToken and returns the
+// order it names
+func openReturnToken(token string) (pid int, alipayOutTradeNo string, err error) {
+	payload, err := sec.OpenToken("return", token, viper.GetString("epay.fwd_secret"))
+	if err != nil {
+		return 0, "", err
+	}
+
+	s, alipayOutTradeNo, ok := strings.Cut(payload, ":")
+	if !ok {
+		return 0, "", errors.New("malformed return token")
+	}
+	if pid, err = strconv.Atoi(s); err != nil {
+		return 0, "", errors.New("malformed return token")
+	}
+	return pid, alipayOutTradeNo, nil
+}
+
+// merchantSignKey collects the key material for signing with a merchant: the
+// derived shared key, the merchant's RSA public key and the platform's RSA
+// private key, the latter two only when configured
+func merchantSignKey(pid int) *epay.SignKey {
+	key := &epay.SignKey{
+		Secret: sec.DeriveMyEpayKey(pid, viper.GetString("epay.fwd_secret")),
+	}
+
+	if s := viper.GetString(misc.MerchantConfigKey(pid, "public_key")); s != "" {
+		pub, err := epay.ParseRSAPublicKey(s)
+		if err != nil {
+			log.Error().Err(err).Int("pid", pid).Msg("Failed to parse merchant public key")
+		}
+		key.PublicKey = pub
+	}
+
+	key.PrivateKey = platformPrivateKey()
+	return key
+}
+
+// platformPrivateKey loads the platform RSA private key, or nil when it is not configured
+func platformPrivateKey() *rsa.PrivateKey {
+	s := viper.GetString("epay.v2.platform_private_key")
+	if s == "" {
+		return nil
+	}
+
+	priv, err := epay.ParseRSAPrivateKey(s)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to parse platform private key")
+		return nil
+	}
+	return priv
+}
 
+// newEnvAlipayClient creates the Alipay client for the environment of the request
+func newEnvAlipayClient(c echo.Context) (*alipay.Client, error) {
+	return newAlipayClientForEnv(epayEnv(c))
+}
+
+// newAlipayClientForEnv creates the Alipay client for an environment, refusing
+// production unless it is enabled
+func newAlipayClientForEnv(env string) (*alipay.Client, error) {
 	isProd := strings.HasPrefix(env, "prod")
-	log.Debug().Bool("is_prod", isProd).Msg("Environment check")
+	log.Debug().Str("env", env).Bool("is_prod", isProd).Msg("Environment check")
 
 	if isProd && !viper.GetBool("alipay.enable_production") {
 		log.Warn().Msg("Production environment is disabled but received production request")
-		return echo.NewHTTPError(http.StatusForbidden, "production environment is disabled")
+		return nil, echo.NewHTTPError(http.StatusForbidden, "production environment is disabled")
 	}
 
-	var client, err = alipay.New(viper.GetString("alipay.app_id"), viper.GetString("alipay.app_private_key"), isProd)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to create Alipay client")
-		c.Logger().Error(err)
-		return err
+	return newAlipayClient(isProd)
+}
+
+const (
+	payMethodPage   = "page"   // alipay.trade.page.pay, for PC browsers
+	payMethodWap    = "wap"    // alipay.trade.wap.pay, for phones and in-app browsers
+	payMethodQRCode = "qrcode" // alipay.trade.precreate, a QR code to scan
+)
+
+var mobileUserAgentRegexp = regexp.MustCompile(`(?i)mobile|android|iphone|ipad|ipod|alipayclient|micromessenger|qq/`)
+
+// resolvePayMethod picks the Alipay product for a submit from the epay device,
+// falling back to the buyer's User-Agent when no device was given
+func resolvePayMethod(device string, userAgent string) string {
+	switch strings.ToLower(device) {
+	case "qrcode":
+		return payMethodQRCode
+	case "pc":
+		return payMethodPage
+	case "":
+		if mobileUserAgentRegexp.MatchString(userAgent) {
+			return payMethodWap
+		}
+		return payMethodPage
+	default:
+		// mobile, wap and the in-app browsers: qq, wechat, alipay
+		return payMethodWap
 	}
-	client.LoadAliPayPublicKey(viper.GetString("alipay.server_public_key"))
+}
+
+// epaySubmission is a validated epay submit request together with the Alipay
+// client and trade prepared for it
+type epaySubmission struct {
+	Param     epay.EpaySubmitRequest
+	TradeNo   string // our trade_no, assigned by recordOrder
+	Env       string
+	Version   int
+	Method    string
+	ExpiresAt time.Time // zero for Alipay's default timeout
+	Client    *alipay.Client
+	Trade     alipay.Trade
+}
+
+// epayPayment is what the buyer needs to pay: a URL to open or a QR code to scan
+type epayPayment struct {
+	PayUrl string
+	QRCode string
+}
 
+// bindEpaySubmitRequest binds an epay submit request and validates its sign
+func bindEpaySubmitRequest(c echo.Context) (*epay.EpaySubmitRequest, error) {
+	log.Info().Str("env", epayEnv(c)).Str("method", c.Request().Method).Msg("Handling Epay submit request")
+
+	// Integrations either link to submit.php with a query string or post a form
 	var epayParam epay.EpaySubmitRequest
-	if err := (&echo.DefaultBinder{}).BindBody(c, &epayParam); err != nil {
+	binder := &echo.DefaultBinder{}
+	if err := binder.BindQueryParams(c, &epayParam); err != nil {
+		log.Error().Err(err).Msg("Failed to bind query parameters to EpaySubmitRequest")
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := binder.BindBody(c, &epayParam); err != nil {
 		log.Error().Err(err).Msg("Failed to bind request body to EpaySubmitRequest")
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	log.Debug().
 		Int("pid", epayParam.Pid).
+		Str("type", epayParam.Type).
 		Str("out_trade_no", epayParam.OutTradeNo).
 		Str("name", epayParam.Name).
 		Str("money", epayParam.Money).
+		Str("device", epayParam.Device).
 		Msg("Received Epay submit parameters")
 
-	val := epay.NewEpaySignValidator(sec.DeriveMyEpayKey(epayParam.Pid, viper.GetString("epay.fwd_secret")))
+	// The sign covers every parameter the merchant sent, not just the ones we model
+	values, err := c.FormParams()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get submit parameters")
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	val := epay.NewEpaySignValidator(merchantSignKey(epayParam.Pid))
 
-	if err := val.Validate(&epayParam); err != nil {
+	if err := val.Validate(values); err != nil {
 		log.Error().Err(err).Int("pid", epayParam.Pid).Msg("Failed to validate Epay signature")
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	log.Debug().Int("pid", epayParam.Pid).Msg("Epay signature validated successfully")
+	return &epayParam, nil
+}
 
-	epayParamCarrier := epay.ParamCarrier{
-		Pid:       epayParam.Pid,
-		NotifyUrl: epayParam.NotifyUrl,
-		Param:     epayParam.Param,
+// prepareEpaySubmission builds the Alipay trade for a validated V1 submit
+// request. It is shared by submit.php, the cashier and mapi.php; only the
+// browser facing ones have the buyer's User-Agent to guess the device from.
+func prepareEpaySubmission(c echo.Context, epayParam *epay.EpaySubmitRequest, userAgent string) (*epaySubmission, error) {
+	if err := checkPayType(epayEnv(c), epayParam.Pid, epayParam.Type); err != nil {
+		return nil, err
 	}
 
-	passbackParams, err := epayParamCarrier.Encode()
+	client, err := newEnvAlipayClient(c)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to encode param carrier")
-		return err
+		return nil, err
+	}
+
+	method := resolvePayMethod(epayParam.Device, userAgent)
+	return newEpaySubmission(client, epayEnv(c), *epayParam, 1, method)
+}
+
+// newEpaySubmission builds the Alipay trade for an already validated submit
+// request, remembering the protocol version and pay method with the order
+func newEpaySubmission(client *alipay.Client, env string, epayParam epay.EpaySubmitRequest, version int, method string) (*epaySubmission, error) {
+	log.Debug().
+		Str("out_trade_no", epayParam.OutTradeNo).
+		Str("device", epayParam.Device).
+		Str("pay_method", method).
+		Msg("Resolved pay method")
+
+	timeout, err := orderTimeout(epayParam.Pid, epayParam.Timeout)
+	if err != nil {
+		log.Warn().Err(err).Int("pid", epayParam.Pid).Str("timeout_express", epayParam.Timeout).Msg("Invalid order timeout")
+		return nil, err
 	}
 
 	notifyUrl, err := buildAlipayNotifyUrl()
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to build Alipay notify URL")
-		return err
+		return nil, err
 	}
 
-	alipayParam := alipay.TradePagePay{
+	var expiresAt time.Time
+	if timeout > 0 {
+		expiresAt = time.Now().Add(timeout)
+	}
+
+	return &epaySubmission{
+		Param:     epayParam,
+		Env:       env,
+		Version:   version,
+		Method:    method,
+		ExpiresAt: expiresAt,
+		Client:    client,
 		Trade: alipay.Trade{
 			NotifyURL: notifyUrl,
-			ReturnURL: epayParam.ReturnUrl,
 
 			Subject:     epayParam.Name,
-			OutTradeNo:  epayParam.OutTradeNo,
 			TotalAmount: epayParam.Money,
-			ProductCode: "FAST_INSTANT_TRADE_PAY",
-
-			PassbackParams: passbackParams,
 		},
-	}
+	}, nil
+}
+
+// pagePayURL creates an Alipay page pay (FAST_INSTANT_TRADE_PAY) URL for the submission
+func (s *epaySubmission) pagePayURL() (string, error) {
+	trade := s.Trade
+	trade.ProductCode = "FAST_INSTANT_TRADE_PAY"
+	applyExpiry(&trade, s.ExpiresAt)
 
 	log.Debug().
-		Str("notify_url", notifyUrl).
-		Str("return_url", epayParam.ReturnUrl).
-		Str("out_trade_no", epayParam.OutTradeNo).
-		Str("subject", epayParam.Name).
-		Str("total_amount", epayParam.Money).
+		Str("notify_url", trade.NotifyURL).
+		Str("return_url", trade.ReturnURL).
+		Str("out_trade_no", trade.OutTradeNo).
+		Str("subject", trade.Subject).
+		Str("total_amount", trade.TotalAmount).
 		Msg("Creating Alipay trade page pay request")
 
-	result, err := client.TradePagePay(alipayParam)
+	result, err := s.Client.TradePagePay(alipay.TradePagePay{Trade: trade})
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to create Alipay trade page pay")
+		return "", err
+	}
+
+	return result.String(), nil
+}
+
+// wapPayURL creates an Alipay wap pay (QUICK_WAP_WAY) URL for the submission
+func (s *epaySubmission) wapPayURL() (string, error) {
+	trade := s.Trade
+	trade.ProductCode = "QUICK_WAP_WAY"
+	applyExpiry(&trade, s.ExpiresAt)
+
+	log.Debug().
+		Str("notify_url", trade.NotifyURL).
+		Str("return_url", trade.ReturnURL).
+		Str("out_trade_no", trade.OutTradeNo).
+		Str("subject", trade.Subject).
+		Str("total_amount", trade.TotalAmount).
+		Msg("Creating Alipay trade wap pay request")
+
+	// The wap product has its own time_expire, without seconds
+	wapPay := alipay.TradeWapPay{Trade: trade, QuitURL: s.Param.ReturnUrl}
+	if !s.ExpiresAt.IsZero() {
+		wapPay.TimeExpire = s.ExpiresAt.In(alipayLocation).Format("2006-01-02 15:04")
+	}
+
+	result, err := s.Client.TradeWapPay(wapPay)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create Alipay trade wap pay")
+		return "", err
+	}
+
+	return result.String(), nil
+}
+
+// precreateQRCode creates an Alipay precreate (FACE_TO_FACE_PAYMENT) trade and
+// returns the QR code content for it
+func (s *epaySubmission) precreateQRCode(ctx context.Context) (string, error) {
+	trade := s.Trade
+	trade.ProductCode = "FACE_TO_FACE_PAYMENT"
+	applyExpiry(&trade, s.ExpiresAt)
+
+	log.Debug().
+		Str("notify_url", trade.NotifyURL).
+		Str("out_trade_no", trade.OutTradeNo).
+		Str("subject", trade.Subject).
+		Str("total_amount", trade.TotalAmount).
+		Msg("Creating Alipay trade precreate request")
+
+	result, err := s.Client.TradePreCreate(ctx, alipay.TradePreCreate{Trade: trade})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create Alipay trade precreate")
+		return "", err
+	}
+	if result.Code.IsFailure() {
+		log.Error().
+			Str("code", string(result.Code)).
+			Str("sub_code", result.SubCode).
+			Str("sub_msg", result.SubMsg).
+			Msg("Alipay trade precreate failed")
+		return "", result.Error
+	}
+
+	return result.QRCode, nil
+}
+
+// recordOrder saves the submitted order before the buyer is sent to Alipay and
+// assigns the trade_no Alipay knows it by. A resubmitted order keeps its
+// trade_no and is returned, after making sure it is the same order and still
+// waiting to be paid.
+func (s *epaySubmission) recordOrder(ctx context.Context) (*store.Order, error) {
+	orders := store.Orders()
+	if orders == nil {
+		return nil, errors.New("order store is not set up")
+	}
+
+	tradeNo, err := epay.NewTradeNo(s.Param.Pid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = orders.CreateOrder(ctx, &store.Order{
+		Pid:        s.Param.Pid,
+		OutTradeNo: s.Param.OutTradeNo,
+		TradeNo:    tradeNo,
+		Env:        s.Env,
+		Type:       s.Param.Type,
+		Name:       s.Param.Name,
+		Money:      s.Param.Money,
+		NotifyUrl:  s.Param.NotifyUrl,
+		ReturnUrl:  s.Param.ReturnUrl,
+		Param:      s.Param.Param,
+		PayMethod:  s.Method,
+		Version:    s.Version,
+		SignType:   s.Param.SignType,
+		ExpiresAt:  s.ExpiresAt,
+	})
+	var existing *store.Order
+	if errors.Is(err, store.ErrOrderExists) {
+		log.Info().Int("pid", s.Param.Pid).Str("out_trade_no", s.Param.OutTradeNo).Msg("Order was already submitted")
+
+		existing, err = orders.GetOrder(ctx, s.Param.Pid, s.Param.OutTradeNo)
+		if err != nil {
+			log.Error().Err(err).Int("pid", s.Param.Pid).Str("out_trade_no", s.Param.OutTradeNo).Msg("Failed to load submitted order")
+			return nil, err
+		}
+		if err := checkResubmission(existing, &s.Param); err != nil {
+			log.Warn().Err(err).Int("pid", s.Param.Pid).Str("out_trade_no", s.Param.OutTradeNo).Msg("Rejected resubmitted order")
+			return nil, err
+		}
+
+		// Orders from before trade_no existed are known by the merchant's number
+		tradeNo = existing.TradeNo
+		if tradeNo == "" {
+			tradeNo = s.Param.OutTradeNo
+		}
+		// Submitting again does not buy the buyer more time
+		s.ExpiresAt = existing.ExpiresAt
+	} else if err != nil {
+		log.Error().Err(err).Int("pid", s.Param.Pid).Str("out_trade_no", s.Param.OutTradeNo).Msg("Failed to record order")
+		return nil, err
+	}
+
+	// Alipay's passback_params is short; what the merchant submitted is in the
+	// store, found by the pid and the out_trade_no Alipay knows the order by
+	s.TradeNo = tradeNo
+	s.Trade.OutTradeNo = tradeNo
+	s.Trade.PassbackParams = strconv.Itoa(s.Param.Pid)
+
+	// The buyer comes back through HandleAlipayReturn, which redirects to the
+	// merchant with epay-signed parameters
+	if s.Param.ReturnUrl != "" {
+		s.Trade.ReturnURL, err = buildAlipayReturnUrl(buildReturnToken(s.Param.Pid, tradeNo))
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to build Alipay return URL")
+			return nil, err
+		}
+	}
+	return existing, nil
+}
+
+// checkResubmission makes sure an order submitted again is the same order and
+// still waiting to be paid
+func checkResubmission(order *store.Order, epayParam *epay.EpaySubmitRequest) error {
+	switch order.Status {
+	case store.OrderPaid, store.OrderRefunded:
+		return echo.NewHTTPError(http.StatusConflict, "order is already paid")
+	case store.OrderClosed:
+		return echo.NewHTTPError(http.StatusConflict, "order is closed")
+	case store.OrderQuarantined:
+		return echo.NewHTTPError(http.StatusConflict, "order is held for review")
+	}
+	if !order.ExpiresAt.IsZero() && time.Now().After(order.ExpiresAt) {
+		return echo.NewHTTPError(http.StatusConflict, "order has expired")
+	}
+
+	var differ []string
+	if !sameAmount(epayParam.Money, order.Money) {
+		differ = append(differ, "money")
+	}
+	if epayParam.Name != order.Name {
+		differ = append(differ, "name")
+	}
+	if epayParam.NotifyUrl != order.NotifyUrl {
+		differ = append(differ, "notify_url")
+	}
+	if epayParam.ReturnUrl != order.ReturnUrl {
+		differ = append(differ, "return_url")
+	}
+	if epayParam.Param != order.Param {
+		differ = append(differ, "param")
+	}
+	if len(differ) > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("out_trade_no %s was already submitted with a different %s", order.OutTradeNo, strings.Join(differ, ", ")))
+	}
+	return nil
+}
+
+// pay records the order and creates the Alipay payment with the method chosen
+// for the submission. An order submitted again with the same parameters gets
+// its pending payment back.
+func (s *epaySubmission) pay(ctx context.Context) (*epayPayment, error) {
+	existing, err := s.recordOrder(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.PayMethod == s.Method && (existing.PayUrl != "" || existing.QRCode != "") {
+		log.Info().
+			Str("trade_no", s.TradeNo).
+			Str("out_trade_no", s.Param.OutTradeNo).
+			Msg("Returning pending payment of resubmitted order")
+		return &epayPayment{PayUrl: existing.PayUrl, QRCode: existing.QRCode}, nil
+	}
+
+	var payment epayPayment
+
+	switch s.Method {
+	case payMethodQRCode:
+		payment.QRCode, err = s.precreateQRCode(ctx)
+	case payMethodWap:
+		payment.PayUrl, err = s.wapPayURL()
+	default:
+		payment.PayUrl, err = s.pagePayURL()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the payment for resubmissions; the buyer can pay without it
+	_, err = store.Orders().UpdateOrder(ctx, s.Param.Pid, s.Param.OutTradeNo, store.OrderUpdate{
+		PayMethod: s.Method,
+		PayUrl:    payment.PayUrl,
+		QRCode:    payment.QRCode,
+		Source:    "submit",
+	})
+	if err != nil {
+		log.Error().Err(err).Str("out_trade_no", s.Param.OutTradeNo).Msg("Failed to save payment of order")
+	}
+
+	return &payment, nil
+}
+
+func HandleEpaySubmit(c echo.Context) error {
+	epayParam, err := bindEpaySubmitRequest(c)
+	if err != nil {
+		return err
+	}
+
+	// Like the stock epay, let the buyer pick when the merchant did not
+	if epayParam.Type == "" {
+		return renderCashier(c, epayParam)
+	}
+
+	return submitEpayPayment(c, epayParam)
+}
+
+// submitEpayPayment creates the payment for a validated submit and sends the
+// buyer on to pay it
+func submitEpayPayment(c echo.Context, epayParam *epay.EpaySubmitRequest) error {
+	s, err := prepareEpaySubmission(c, epayParam, c.Request().UserAgent())
+	if err != nil {
 		return err
 	}
 
+	payment, err := s.pay(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	if payment.QRCode != "" {
+		log.Info().
+			Str("out_trade_no", s.Param.OutTradeNo).
+			Str("qrcode", payment.QRCode).
+			Msg("Showing Alipay QR code")
+
+		return c.Render(http.StatusOK, "qrcode.html", web.QRCodePage{
+			OutTradeNo: s.Param.OutTradeNo,
+			Name:       s.Param.Name,
+			Money:      s.Param.Money,
+			QRCode:     payment.QRCode,
+		})
+	}
+
 	log.Info().
-		Str("out_trade_no", epayParam.OutTradeNo).
-		Str("redirect_url", result.String()).
+		Str("out_trade_no", s.Param.OutTradeNo).
+		Str("pay_method", s.Method).
+		Str("redirect_url", payment.PayUrl).
 		Msg("Redirecting to Alipay payment page")
 
 	// return c.Redirect(http.StatusTemporaryRedirect, result.String())
 	// 必须使用 302，否则 epay 的 POST body 会被保留
-	return c.Redirect(http.StatusFound, result.String())
+	return c.Redirect(http.StatusFound, payment.PayUrl)
+}
+
+// HandleEpayMapi handles the API-mode submit (mapi.php). Instead of redirecting
+// the buyer, it replies with the epay JSON envelope containing a QR code for
+// device=qrcode, or a pay URL otherwise.
+func HandleEpayMapi(c echo.Context) error {
+	epayParam, err := bindEpaySubmitRequest(c)
+	if err != nil {
+		return epayApiError(c, err)
+	}
+
+	s, err := prepareEpaySubmission(c, epayParam, "")
+	if err != nil {
+		return epayApiError(c, err)
+	}
+
+	payment, err := s.pay(c.Request().Context())
+	if err != nil {
+		return epayApiError(c, err)
+	}
+
+	resp := epay.EpayMapiResponse{
+		Code:    epay.EpayCodeSuccess,
+		Msg:     "success",
+		TradeNo: s.TradeNo,
+		PayUrl:  payment.PayUrl,
+		QRCode:  payment.QRCode,
+	}
+
+	log.Info().
+		Str("out_trade_no", s.Param.OutTradeNo).
+		Str("payurl", resp.PayUrl).
+		Str("qrcode", resp.QRCode).
+		Msg("Replying to Epay mapi request")
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// epayApiError replies with an epay JSON error envelope, which is what epay
+// API clients expect instead of an HTTP error status
+func epayApiError(c echo.Context, err error) error {
+	msg := err.Error()
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		if m, ok := he.Message.(string); ok {
+			msg = m
+		}
+	}
+
+	return c.JSON(http.StatusOK, epay.EpayApiResponse{
+		Code: epay.EpayCodeFailure,
+		Msg:  msg,
+	})
 }
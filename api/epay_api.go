@@ -0,0 +1,347 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/smartwalle/alipay/v3"
+	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/epay"
+	"github.com/yiffyi/epay-fwd/sec"
+	"github.com/yiffyi/epay-fwd/store"
+)
+
+// isTradePaid reports whether an Alipay trade status means the order is paid
+func isTradePaid(status alipay.TradeStatus) bool {
+	return status == alipay.TradeStatusSuccess || status == alipay.TradeStatusFinished
+}
+
+// tradeNotification fills a notification from a queried trade, for building
+// epay notifications without one from Alipay
+func tradeNotification(trade *alipay.TradeQueryRsp) *alipay.Notification {
+	return &alipay.Notification{
+		TradeNo:      trade.TradeNo,
+		OutTradeNo:   trade.OutTradeNo,
+		TradeStatus:  trade.TradeStatus,
+		Subject:      trade.Subject,
+		TotalAmount:  trade.TotalAmount,
+		BuyerLogonId: trade.BuyerLogonId,
+		GmtPayment:   trade.SendPayDate,
+	}
+}
+
+// HandleEpayApi handles api.php, dispatching on the act parameter
+func HandleEpayApi(c echo.Context) error {
+	var req epay.EpayApiRequest
+	binder := &echo.DefaultBinder{}
+	if err := binder.BindQueryParams(c, &req); err != nil {
+		log.Error().Err(err).Msg("Failed to bind query parameters to EpayApiRequest")
+		return epayApiError(c, echo.NewHTTPError(http.StatusBadRequest, err.Error()))
+	}
+	if err := binder.BindBody(c, &req); err != nil {
+		log.Error().Err(err).Msg("Failed to bind request body to EpayApiRequest")
+		return epayApiError(c, echo.NewHTTPError(http.StatusBadRequest, err.Error()))
+	}
+
+	log.Info().Str("act", req.Act).Int("pid", req.Pid).Msg("Handling Epay api request")
+
+	if !sec.VerifyMyEpayKey(req.Pid, req.Key, viper.GetString("epay.fwd_secret")) {
+		log.Warn().Int("pid", req.Pid).Msg("Invalid merchant key in Epay api request")
+		return epayApiError(c, echo.NewHTTPError(http.StatusForbidden, "invalid pid or key"))
+	}
+
+	switch req.Act {
+	case "order":
+		return handleEpayApiOrder(c, &req)
+	case "refund":
+		return handleEpayApiRefund(c, &req)
+	case "notify_log":
+		return handleEpayApiNotifyLog(c, &req)
+	default:
+		return epayApiError(c, echo.NewHTTPError(http.StatusBadRequest, "unsupported act"))
+	}
+}
+
+// queryMerchantTrade looks up the trade named by req at Alipay, in the
+// environment the order was created in, and makes sure it was submitted by the
+// requesting merchant. It returns the client for that environment. Orders
+// missing from the store are looked up in the environment of the request.
+func queryMerchantTrade(c echo.Context, req *epay.EpayApiRequest) (*alipay.Client, *alipay.TradeQueryRsp, *epay.ParamCarrier, error) {
+	if req.OutTradeNo == "" && req.TradeNo == "" {
+		return nil, nil, nil, echo.NewHTTPError(http.StatusBadRequest, "out_trade_no or trade_no is required")
+	}
+
+	query, order, err := alipayTradeQuery(c.Request().Context(), req.Pid, req.TradeNo, req.OutTradeNo)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	client, err := newAlipayClientForEnv(orderEnv(order, epayEnv(c)))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	rsp, err := client.TradeQuery(c.Request().Context(), query)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to query Alipay trade")
+		return nil, nil, nil, err
+	}
+	// Alipay only knows a trade once the buyer has opened the payment page
+	if rsp.SubCode == "ACQ.TRADE_NOT_EXIST" && order != nil && order.Pid == req.Pid {
+		log.Info().
+			Str("out_trade_no", order.OutTradeNo).
+			Msg("Order is not known to Alipay yet, answering from the store")
+		rsp = unopenedTrade(order)
+	}
+	if rsp.Code.IsFailure() {
+		log.Warn().
+			Str("out_trade_no", req.OutTradeNo).
+			Str("trade_no", req.TradeNo).
+			Str("sub_code", rsp.SubCode).
+			Str("sub_msg", rsp.SubMsg).
+			Msg("Alipay trade query failed")
+		return nil, nil, nil, echo.NewHTTPError(http.StatusNotFound, "order not found")
+	}
+
+	// The order belongs to whoever submitted it; never disclose other merchants' orders
+	carrier, _, err := tradeCarrier(c.Request().Context(), rsp.OutTradeNo, rsp.PassbackParams)
+	if err != nil || carrier.Pid != req.Pid {
+		log.Warn().Err(err).Int("pid", req.Pid).Str("trade_no", rsp.TradeNo).Msg("Queried order does not belong to merchant")
+		return nil, nil, nil, echo.NewHTTPError(http.StatusNotFound, "order not found")
+	}
+
+	return client, rsp, carrier, nil
+}
+
+// unopenedTrade stands in for the Alipay trade of a stored order the buyer has
+// not opened yet, as an unpaid one
+func unopenedTrade(order *store.Order) *alipay.TradeQueryRsp {
+	return &alipay.TradeQueryRsp{
+		Error:          alipay.Error{Code: alipay.CodeSuccess},
+		OutTradeNo:     alipayOutTradeNo(order),
+		TotalAmount:    order.Money,
+		Subject:        order.Name,
+		PassbackParams: strconv.Itoa(order.Pid),
+	}
+}
+
+// buildOrderResponse describes a queried Alipay trade in epay terms. Trades of
+// quarantined orders are not reported as paid.
+func buildOrderResponse(ctx context.Context, rsp *alipay.TradeQueryRsp, carrier *epay.ParamCarrier) (*epay.EpayOrderResponse, error) {
+	tradeNo, outTradeNo := carrier.OrderNos(rsp.TradeNo, rsp.OutTradeNo)
+	order, err := findOrder(ctx, carrier.Pid, outTradeNo)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &epay.EpayOrderResponse{
+		Code:       epay.EpayCodeSuccess,
+		Msg:        "success",
+		TradeNo:    tradeNo,
+		OutTradeNo: outTradeNo,
+		ApiTradeNo: rsp.TradeNo,
+		Type:       "alipay",
+		Pid:        carrier.Pid,
+		Name:       rsp.Subject,
+		Money:      rsp.TotalAmount,
+		Param:      carrier.Param,
+		Buyer:      rsp.BuyerLogonId,
+	}
+
+	// Alipay does not tell when a trade was created, only when it was paid
+	if order != nil {
+		resp.Addtime = order.CreatedAt.In(alipayLocation).Format(alipayTimeLayout)
+	} else {
+		resp.Addtime = rsp.SendPayDate
+	}
+
+	if isTradePaid(rsp.TradeStatus) && (order == nil || order.Status != store.OrderQuarantined) {
+		resp.Status = 1
+		resp.Endtime = rsp.SendPayDate
+	}
+	return resp, nil
+}
+
+// handleEpayApiOrder answers act=order from Alipay TradeQuery, so the result is
+// correct even when a notification was lost
+func handleEpayApiOrder(c echo.Context, req *epay.EpayApiRequest) error {
+	_, rsp, carrier, err := queryMerchantTrade(c, req)
+	if err != nil {
+		return epayApiError(c, err)
+	}
+
+	resp, err := buildOrderResponse(c.Request().Context(), rsp, carrier)
+	if err != nil {
+		return epayApiError(c, err)
+	}
+
+	log.Info().
+		Str("out_trade_no", resp.OutTradeNo).
+		Str("trade_status", string(rsp.TradeStatus)).
+		Msg("Replying to Epay order query")
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// refundRequestNo returns the Alipay out_request_no for a refund. A merchant
+// supplied out_refund_no is used as is; otherwise it is derived from the trade
+// and amount, so that retrying the same refund never refunds twice. Two
+// refunds of the same amount derive the same number, the second one needs an
+// out_refund_no of its own.
+func refundRequestNo(tradeNo string, req *epay.EpayApiRequest) string {
+	if req.OutRefundNo != "" {
+		return req.OutRefundNo
+	}
+
+	hash := sha256.Sum256([]byte(tradeNo + "|" + req.Money))
+	return "RF" + hex.EncodeToString(hash[:15])
+}
+
+// findRefund returns the refund made with outRequestNo, or nil if there is
+// none yet
+func findRefund(ctx context.Context, client *alipay.Client, tradeNo, outRequestNo string) (*alipay.TradeFastPayRefundQueryRsp, error) {
+	rsp, err := client.TradeFastPayRefundQuery(ctx, alipay.TradeFastPayRefundQuery{
+		TradeNo:      tradeNo,
+		OutRequestNo: outRequestNo,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to query Alipay trade refund")
+		return nil, err
+	}
+	if rsp.Code.IsFailure() {
+		log.Error().
+			Str("trade_no", tradeNo).
+			Str("sub_code", rsp.SubCode).
+			Str("sub_msg", rsp.SubMsg).
+			Msg("Alipay trade refund query failed")
+		return nil, echo.NewHTTPError(http.StatusBadRequest, rsp.SubMsg)
+	}
+
+	if rsp.RefundStatus == "" && rsp.RefundAmount == "" {
+		return nil, nil
+	}
+	return rsp, nil
+}
+
+// merchantRefund is a refund done at Alipay, in epay terms
+type merchantRefund struct {
+	TradeNo     string // epay trade_no of the order
+	OutRefundNo string // the out_request_no used at Alipay
+	RefundFee   string // total refunded from the order
+}
+
+// refundMerchantTrade refunds (part of) a merchant's paid trade at Alipay
+func refundMerchantTrade(c echo.Context, req *epay.EpayApiRequest) (*merchantRefund, error) {
+	if req.Money == "" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "money is required")
+	}
+
+	client, trade, carrier, err := queryMerchantTrade(c, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isTradePaid(trade.TradeStatus) {
+		log.Warn().Str("trade_no", trade.TradeNo).Str("trade_status", string(trade.TradeStatus)).Msg("Refund requested for unpaid order")
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "order is not paid")
+	}
+
+	// Money of a quarantined order stays put until an operator has looked at it
+	_, outTradeNo := carrier.OrderNos(trade.TradeNo, trade.OutTradeNo)
+	order, err := findOrder(c.Request().Context(), carrier.Pid, outTradeNo)
+	if err != nil {
+		return nil, err
+	}
+	if order != nil && order.Status == store.OrderQuarantined {
+		log.Warn().Str("out_trade_no", order.OutTradeNo).Msg("Refund requested for quarantined order")
+		return nil, echo.NewHTTPError(http.StatusConflict, "order is held for review")
+	}
+
+	// A retry of a refund whose response was lost finds it made. Refunding
+	// again with its out_request_no makes Alipay answer with that refund
+	// without moving any money.
+	outRequestNo := refundRequestNo(trade.TradeNo, req)
+	if req.OutRefundNo == "" {
+		existing, err := findRefund(c.Request().Context(), client, trade.TradeNo, outRequestNo)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			if !sameAmount(existing.RefundAmount, req.Money) {
+				log.Warn().
+					Str("trade_no", trade.TradeNo).
+					Str("out_request_no", outRequestNo).
+					Str("refund_amount", existing.RefundAmount).
+					Msg("Refund of the derived out_request_no has another amount")
+				return nil, echo.NewHTTPError(http.StatusConflict, "a different refund was already made with this out_request_no")
+			}
+			log.Info().
+				Str("trade_no", trade.TradeNo).
+				Str("out_request_no", outRequestNo).
+				Str("refund_status", existing.RefundStatus).
+				Msg("Refund was already made, replying with it")
+		}
+	}
+
+	log.Info().
+		Int("pid", req.Pid).
+		Str("trade_no", trade.TradeNo).
+		Str("out_request_no", outRequestNo).
+		Str("refund_amount", req.Money).
+		Msg("Requesting Alipay trade refund")
+
+	rsp, err := client.TradeRefund(c.Request().Context(), alipay.TradeRefund{
+		TradeNo:      trade.TradeNo,
+		RefundAmount: req.Money,
+		OutRequestNo: outRequestNo,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to request Alipay trade refund")
+		return nil, err
+	}
+	if rsp.Code.IsFailure() {
+		log.Error().
+			Str("trade_no", trade.TradeNo).
+			Str("sub_code", rsp.SubCode).
+			Str("sub_msg", rsp.SubMsg).
+			Msg("Alipay trade refund failed")
+		return nil, echo.NewHTTPError(http.StatusBadRequest, rsp.SubMsg)
+	}
+
+	log.Info().
+		Str("trade_no", rsp.TradeNo).
+		Str("out_request_no", outRequestNo).
+		Str("refund_fee", rsp.RefundFee).
+		Str("fund_change", rsp.FundChange).
+		Msg("Alipay trade refunded")
+
+	tradeNo, _ := carrier.OrderNos(trade.TradeNo, trade.OutTradeNo)
+	return &merchantRefund{
+		TradeNo:     tradeNo,
+		OutRefundNo: outRequestNo,
+		RefundFee:   rsp.RefundFee,
+	}, nil
+}
+
+// handleEpayApiRefund forwards act=refund to Alipay TradeRefund in the
+// environment the order was created in. Partial refunds are supported.
+func handleEpayApiRefund(c echo.Context, req *epay.EpayApiRequest) error {
+	refund, err := refundMerchantTrade(c, req)
+	if err != nil {
+		return epayApiError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, epay.EpayRefundResponse{
+		Code:        epay.EpayCodeSuccess,
+		Msg:         "退款成功",
+		TradeNo:     refund.TradeNo,
+		OutRefundNo: refund.OutRefundNo,
+		Money:       req.Money,
+		RefundFee:   refund.RefundFee,
+	})
+}
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/yiffyi/epay-fwd/epay"
+	"github.com/yiffyi/epay-fwd/sec"
+	"github.com/yiffyi/epay-fwd/store"
+)
+
+// callEpayApi posts an api.php request of merchant 1001 and decodes the reply
+func callEpayApi(t *testing.T, values url.Values, resp any) {
+	t.Helper()
+
+	values.Set("pid", "1001")
+	values.Set("key", sec.DeriveMyEpayKey(1001, "test-secret"))
+
+	e := echo.New()
+	SetupEpayEndpoints(e.Group("/epay"))
+	req := httptest.NewRequest(http.MethodPost, "/epay/sandbox/api.php", strings.NewReader(values.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+		t.Fatalf("api.php replied %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+// testTrade is a trade of merchant 1001 at the test gateway, refunded like
+// Alipay does: a refund with a used out_request_no is answered with the
+// earlier one and moves no money
+type testTrade struct {
+	order  *store.Order
+	status string
+
+	mu       sync.Mutex
+	refunds  map[string]string // refund amounts by out_request_no
+	refunded *big.Rat
+}
+
+func (g *testGateway) serveTrade(order *store.Order, status string) *testTrade {
+	trade := &testTrade{order: order, status: status, refunds: make(map[string]string), refunded: new(big.Rat)}
+
+	g.handle("alipay.trade.query", func(biz map[string]any) any {
+		if biz["out_trade_no"] != order.TradeNo {
+			return map[string]any{"code": "40004", "msg": "Business Failed", "sub_code": "ACQ.TRADE_NOT_EXIST", "sub_msg": "交易不存在"}
+		}
+		return map[string]any{"code": "10000", "msg": "Success", "trade_no": "2024010222001400000001",
+			"out_trade_no": order.TradeNo, "trade_status": trade.status, "total_amount": order.Money,
+			"subject": order.Name, "passback_params": strconv.Itoa(order.Pid), "send_pay_date": "2024-01-02 03:01:00"}
+	})
+	g.handle("alipay.trade.fastpay.refund.query", func(biz map[string]any) any {
+		trade.mu.Lock()
+		defer trade.mu.Unlock()
+		no, _ := biz["out_request_no"].(string)
+		amount, ok := trade.refunds[no]
+		if !ok {
+			return map[string]any{"code": "10000", "msg": "Success"}
+		}
+		return map[string]any{"code": "10000", "msg": "Success", "out_request_no": no,
+			"refund_amount": amount, "refund_status": "REFUND_SUCCESS"}
+	})
+	g.handle("alipay.trade.refund", func(biz map[string]any) any {
+		trade.mu.Lock()
+		defer trade.mu.Unlock()
+		no, _ := biz["out_request_no"].(string)
+		fundChange := "N"
+		if _, ok := trade.refunds[no]; !ok {
+			amount, _ := biz["refund_amount"].(string)
+			r, _ := new(big.Rat).SetString(amount)
+			trade.refunds[no] = amount
+			trade.refunded.Add(trade.refunded, r)
+			fundChange = "Y"
+		}
+		return map[string]any{"code": "10000", "msg": "Success", "trade_no": "2024010222001400000001",
+			"out_trade_no": order.TradeNo, "fund_change": fundChange, "refund_fee": trade.refunded.FloatString(2)}
+	})
+	return trade
+}
+
+// refundedTotal returns how much money has left the trade
+func (trade *testTrade) refundedTotal() string {
+	trade.mu.Lock()
+	defer trade.mu.Unlock()
+	return trade.refunded.FloatString(2)
+}
+
+func TestEpayApiRefund(t *testing.T) {
+	setupTestStore(t)
+	g := setupTestAlipay(t).serveGateway(t)
+	order := createTestOrder(t, "O1", store.OrderPaid)
+	trade := g.serveTrade(order, "TRADE_SUCCESS")
+
+	steps := []struct {
+		name          string
+		money         string
+		outRefundNo   string
+		wantRefundFee string
+		wantRefunded  string
+	}{
+		{"refund", "0.40", "", "0.40", "0.40"},
+		// The reply to the first one was lost
+		{"retry", "0.40", "", "0.40", "0.40"},
+		{"same amount again", "0.40", "R2", "0.80", "0.80"},
+		{"retry with out_refund_no", "0.40", "R2", "0.80", "0.80"},
+		{"another amount", "0.20", "", "1.00", "1.00"},
+	}
+
+	var derived string
+	for _, step := range steps {
+		var resp struct {
+			Code        int    `json:"code"`
+			Msg         string `json:"msg"`
+			OutRefundNo string `json:"out_refund_no"`
+			RefundFee   string `json:"refund_fee"`
+		}
+		callEpayApi(t, url.Values{"act": {"refund"}, "out_trade_no": {"O1"}, "money": {step.money},
+			"out_refund_no": {step.outRefundNo}}, &resp)
+		if resp.Code != 1 || resp.RefundFee != step.wantRefundFee {
+			t.Fatalf("%s: reply = %+v, want refund_fee %s", step.name, resp, step.wantRefundFee)
+		}
+		if got := trade.refundedTotal(); got != step.wantRefunded {
+			t.Fatalf("%s: %s refunded, want %s", step.name, got, step.wantRefunded)
+		}
+
+		switch {
+		case step.outRefundNo != "" && resp.OutRefundNo != step.outRefundNo:
+			t.Errorf("%s: out_refund_no = %s, want %s", step.name, resp.OutRefundNo, step.outRefundNo)
+		case step.name == "refund":
+			derived = resp.OutRefundNo
+		case step.name == "retry" && resp.OutRefundNo != derived:
+			t.Errorf("retry: out_refund_no = %s, want %s", resp.OutRefundNo, derived)
+		}
+	}
+}
+
+func TestEpayApiRefundRefused(t *testing.T) {
+	setupTestStore(t)
+	g := setupTestAlipay(t).serveGateway(t)
+
+	tests := []struct {
+		name        string
+		status      store.OrderStatus
+		tradeStatus string
+		wantMsg     string
+	}{
+		{"quarantined", store.OrderQuarantined, "TRADE_SUCCESS", "order is held for review"},
+		{"not paid", store.OrderCreated, "WAIT_BUYER_PAY", "order is not paid"},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := createTestOrder(t, fmt.Sprintf("O%d", i+1), tt.status)
+			trade := g.serveTrade(order, tt.tradeStatus)
+
+			var resp struct {
+				Code int    `json:"code"`
+				Msg  string `json:"msg"`
+			}
+			callEpayApi(t, url.Values{"act": {"refund"}, "out_trade_no": {order.OutTradeNo}, "money": {"0.40"}}, &resp)
+			if resp.Code == 1 || resp.Msg != tt.wantMsg {
+				t.Errorf("reply = %+v, want %q", resp, tt.wantMsg)
+			}
+			if got := trade.refundedTotal(); got != "0.00" {
+				t.Errorf("%s refunded", got)
+			}
+		})
+	}
+	for _, method := range g.called() {
+		if method != "alipay.trade.query" {
+			t.Errorf("%s called for an order that cannot be refunded", method)
+		}
+	}
+}
+
+// Orders the buyer has not opened yet are unknown to Alipay, but not unpaid
+func TestEpayApiOrderNotOpened(t *testing.T) {
+	orders := setupTestStore(t)
+	g := setupTestAlipay(t).serveGateway(t)
+	g.handle("alipay.trade.query", func(biz map[string]any) any {
+		return map[string]any{"code": "40004", "msg": "Business Failed", "sub_code": "ACQ.TRADE_NOT_EXIST", "sub_msg": "交易不存在"}
+	})
+
+	createTestOrder(t, "O1", store.OrderCreated)
+	other := &store.Order{Pid: 1002, OutTradeNo: "O2", TradeNo: "TO2", Env: "sandbox", Type: "alipay", Name: "VIP",
+		Money: "2.00", NotifyUrl: "https://shop.example.com/notify.php", PayMethod: payMethodPage, Version: 1}
+	if err := orders.CreateOrder(t.Context(), other); err != nil {
+		t.Fatalf("CreateOrder() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		values  url.Values
+		wantMsg string // of a failure
+	}{
+		{"by out_trade_no", url.Values{"out_trade_no": {"O1"}}, ""},
+		{"by trade_no", url.Values{"trade_no": {"TO1"}}, ""},
+		{"missing", url.Values{"out_trade_no": {"O9"}}, "order not found"},
+		{"of another merchant", url.Values{"trade_no": {"TO2"}}, "order not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.values.Set("act", "order")
+			var resp epay.EpayOrderResponse
+			callEpayApi(t, tt.values, &resp)
+
+			if tt.wantMsg != "" {
+				if resp.Code == epay.EpayCodeSuccess || resp.Msg != tt.wantMsg {
+					t.Errorf("reply = %+v, want %q", resp, tt.wantMsg)
+				}
+				return
+			}
+			if resp.Code != epay.EpayCodeSuccess || resp.Status != 0 || resp.TradeNo != "TO1" || resp.OutTradeNo != "O1" ||
+				resp.Pid != 1001 || resp.Money != "1.00" || resp.Name != "VIP" || resp.Addtime == "" || resp.Endtime != "" {
+				t.Errorf("reply = %+v", resp)
+			}
+		})
+	}
+
+	// Nor can they be refunded
+	var resp epay.EpayRefundResponse
+	callEpayApi(t, url.Values{"act": {"refund"}, "out_trade_no": {"O1"}, "money": {"1.00"}}, &resp)
+	if resp.Code == epay.EpayCodeSuccess || resp.Msg != "order is not paid" {
+		t.Errorf("refund reply = %+v", resp)
+	}
+}
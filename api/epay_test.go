@@ -0,0 +1,234 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/epay"
+	"github.com/yiffyi/epay-fwd/sec"
+	"github.com/yiffyi/epay-fwd/store"
+)
+
+func TestRecordOrderAlipayLimits(t *testing.T) {
+	setupTestStore(t)
+	viper.Set("site_url", "https://pay.example.com")
+	viper.Set("epay.fwd_secret", "test-secret")
+
+	// Alipay caps return_url at 256 characters and passback_params at 512,
+	// whatever the merchant sends
+	param := epay.EpaySubmitRequest{
+		Pid:        1001,
+		Type:       "alipay",
+		OutTradeNo: "ORDER-" + strings.Repeat("1", 58),
+		NotifyUrl:  "https://shop.example.com/" + strings.Repeat("n", 100) + "/notify.php",
+		ReturnUrl:  "https://shop.example.com/" + strings.Repeat("r", 200) + "/return.php?from=epay",
+		Name:       "VIP",
+		Money:      "1.00",
+		Param:      strings.Repeat("p", 120),
+	}
+
+	s, err := newEpaySubmission(nil, "sandbox", param, 1, payMethodPage)
+	if err != nil {
+		t.Fatalf("newEpaySubmission() error = %v", err)
+	}
+	if _, err := s.recordOrder(t.Context()); err != nil {
+		t.Fatalf("recordOrder() error = %v", err)
+	}
+
+	if n := len(s.Trade.ReturnURL); n == 0 || n > 256 {
+		t.Errorf("return_url is %d characters: %s", n, s.Trade.ReturnURL)
+	}
+	if n := len(s.Trade.PassbackParams); n == 0 || n > 512 {
+		t.Errorf("passback_params is %d characters: %s", n, s.Trade.PassbackParams)
+	}
+
+	returnURL, err := url.Parse(s.Trade.ReturnURL)
+	if err != nil {
+		t.Fatalf("invalid return_url: %v", err)
+	}
+	pid, alipayOutTradeNo, err := openReturnToken(strings.TrimPrefix(returnURL.Path, "/alipay/return/"))
+	if err != nil {
+		t.Fatalf("openReturnToken() error = %v", err)
+	}
+	if pid != 1001 || alipayOutTradeNo != s.TradeNo {
+		t.Errorf("return token names %d %s, want 1001 %s", pid, alipayOutTradeNo, s.TradeNo)
+	}
+
+	carrier, order, err := tradeCarrier(t.Context(), s.Trade.OutTradeNo, s.Trade.PassbackParams)
+	if err != nil {
+		t.Fatalf("tradeCarrier() error = %v", err)
+	}
+	if order == nil || carrier.NotifyUrl != param.NotifyUrl || carrier.Param != param.Param || order.ReturnUrl != param.ReturnUrl {
+		t.Errorf("order of the trade = %+v", order)
+	}
+}
+
+func TestOpenReturnToken(t *testing.T) {
+	viper.Set("epay.fwd_secret", "test-secret")
+	token := buildReturnToken(1001, "2024010203040510011234")
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"tampered trade", strings.Replace(token, "1234", "1235", 1)},
+		{"tampered pid", strings.Replace(token, "1001:", "1002:", 1)},
+		{"other purpose", sec.SignToken("other", "1001:2024010203040510011234", "test-secret")},
+		{"other secret", sec.SignToken("return", "1001:2024010203040510011234", "other-secret")},
+		{"without pid", sec.SignToken("return", "2024010203040510011234", "test-secret")},
+		{"empty", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if pid, no, err := openReturnToken(tt.token); err == nil {
+				t.Errorf("openReturnToken() = %d %s, want an error", pid, no)
+			}
+		})
+	}
+
+	pid, alipayOutTradeNo, err := openReturnToken(token)
+	if err != nil || pid != 1001 || alipayOutTradeNo != "2024010203040510011234" {
+		t.Errorf("openReturnToken() = %d, %s, %v", pid, alipayOutTradeNo, err)
+	}
+}
+
+// submitMapi posts a submit signed by merchant 1001 to mapi.php
+func submitMapi(t *testing.T, e *echo.Echo, param epay.EpaySubmitRequest) epay.EpayMapiResponse {
+	t.Helper()
+
+	values := param.ToURLValues()
+	values.Del("sign")
+	if err := epay.SignValues(values, merchantSignKey(param.Pid)); err != nil {
+		t.Fatalf("SignValues() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/epay/sandbox/mapi.php", strings.NewReader(values.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	var resp epay.EpayMapiResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("mapi.php replied %d %s", rec.Code, rec.Body.String())
+	}
+	return resp
+}
+
+func TestEpayResubmission(t *testing.T) {
+	orders := setupTestStore(t)
+	setupTestAlipay(t)
+	viper.Set("site_url", "https://pay.example.com")
+	viper.Set("epay.types", []string{"alipay"})
+
+	e := echo.New()
+	SetupEpayEndpoints(e.Group("/epay"))
+
+	submitted := epay.EpaySubmitRequest{
+		Pid:        1001,
+		Type:       "alipay",
+		OutTradeNo: "O1",
+		NotifyUrl:  "https://shop.example.com/notify.php",
+		ReturnUrl:  "https://shop.example.com/return.php",
+		Name:       "VIP",
+		Money:      "1.00",
+		Param:      "extra",
+	}
+	first := submitMapi(t, e, submitted)
+	if first.Code != epay.EpayCodeSuccess || first.PayUrl == "" || first.TradeNo == "" {
+		t.Fatalf("first submit = %+v", first)
+	}
+
+	changed := func(change func(p *epay.EpaySubmitRequest)) epay.EpaySubmitRequest {
+		p := submitted
+		change(&p)
+		return p
+	}
+
+	tests := []struct {
+		name       string
+		param      epay.EpaySubmitRequest
+		wantMsg    string // empty for success
+		samePayUrl bool
+	}{
+		{"identical", submitted, "", true},
+		{"same amount written differently", changed(func(p *epay.EpaySubmitRequest) { p.Money = "1.0" }), "", true},
+		{"other pay method", changed(func(p *epay.EpaySubmitRequest) { p.Device = "mobile" }), "", false},
+		{"different money", changed(func(p *epay.EpaySubmitRequest) { p.Money = "2.00" }), "different money", false},
+		{"different name", changed(func(p *epay.EpaySubmitRequest) { p.Name = "SVIP" }), "different name", false},
+		{"different everything", changed(func(p *epay.EpaySubmitRequest) {
+			p.Money, p.NotifyUrl, p.ReturnUrl, p.Param = "2.00", "https://evil.example.com/", "", "other"
+		}), "different money, notify_url, return_url, param", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := submitMapi(t, e, tt.param)
+			if tt.wantMsg != "" {
+				if resp.Code != epay.EpayCodeFailure || !strings.Contains(resp.Msg, tt.wantMsg) {
+					t.Errorf("submit = %+v, want an error about %q", resp, tt.wantMsg)
+				}
+				return
+			}
+
+			if resp.Code != epay.EpayCodeSuccess || resp.TradeNo != first.TradeNo {
+				t.Fatalf("submit = %+v, want trade_no %s", resp, first.TradeNo)
+			}
+			if (resp.PayUrl == first.PayUrl) != tt.samePayUrl {
+				t.Errorf("submit pay url %s, first %s", resp.PayUrl, first.PayUrl)
+			}
+		})
+	}
+
+	// Nothing about the order changed
+	order, err := orders.GetOrder(t.Context(), 1001, "O1")
+	if err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+	if order.Money != "1.00" || order.Name != "VIP" || order.TradeNo != first.TradeNo || order.Status != store.OrderCreated {
+		t.Errorf("order after resubmissions = %+v", order)
+	}
+
+	for _, status := range []struct {
+		status  store.OrderStatus
+		wantMsg string
+	}{
+		{store.OrderPaid, "order is already paid"},
+		{store.OrderRefunded, "order is already paid"},
+	} {
+		if _, err := orders.UpdateOrder(t.Context(), 1001, "O1", store.OrderUpdate{Status: status.status}); err != nil {
+			t.Fatalf("UpdateOrder() error = %v", err)
+		}
+		if resp := submitMapi(t, e, submitted); resp.Code != epay.EpayCodeFailure || resp.Msg != status.wantMsg {
+			t.Errorf("submit of a %s order = %+v", status.status, resp)
+		}
+	}
+
+	closed := changed(func(p *epay.EpaySubmitRequest) { p.OutTradeNo = "O2" })
+	submitMapi(t, e, closed)
+	if _, err := orders.UpdateOrder(t.Context(), 1001, "O2", store.OrderUpdate{Status: store.OrderClosed}); err != nil {
+		t.Fatalf("UpdateOrder() error = %v", err)
+	}
+	if resp := submitMapi(t, e, closed); resp.Code != epay.EpayCodeFailure || resp.Msg != "order is closed" {
+		t.Errorf("submit of a closed order = %+v", resp)
+	}
+
+	// An expired order is not paid again, even before the sweeper closes it
+	expired := changed(func(p *epay.EpaySubmitRequest) { p.OutTradeNo = "O3" })
+	err = orders.CreateOrder(t.Context(), &store.Order{Pid: 1001, OutTradeNo: "O3", TradeNo: "TO3", Env: "sandbox", Type: "alipay",
+		Name: expired.Name, Money: expired.Money, NotifyUrl: expired.NotifyUrl, ReturnUrl: expired.ReturnUrl, Param: expired.Param,
+		PayMethod: payMethodPage, Version: 1, ExpiresAt: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("CreateOrder() error = %v", err)
+	}
+	if resp := submitMapi(t, e, expired); resp.Code != epay.EpayCodeFailure || resp.Msg != "order has expired" {
+		t.Errorf("submit of an expired order = %+v", resp)
+	}
+}
@@ -0,0 +1,244 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/epay"
+)
+
+// epayV2SignType is the only sign type spoken by the V2 protocol
+const epayV2SignType = "RSA"
+
+// verifyEpayV2Request checks the timestamp and the merchant's RSA sign over all
+// parameters of a V2 request
+func verifyEpayV2Request(c echo.Context, pid int) error {
+	values, err := c.FormParams()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get Epay V2 request parameters")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if !strings.EqualFold(values.Get("sign_type"), epayV2SignType) {
+		return echo.NewHTTPError(http.StatusBadRequest, "unsupported sign_type")
+	}
+
+	timestamp := values.Get("timestamp")
+	if err := epay.CheckTimestamp(timestamp, viper.GetDuration("epay.v2.timestamp_tolerance")); err != nil {
+		log.Warn().Err(err).Int("pid", pid).Str("timestamp", timestamp).Msg("Rejected Epay V2 request timestamp")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	key := merchantSignKey(pid)
+	if key.PublicKey == nil {
+		log.Error().Int("pid", pid).Msg("Merchant public key is not configured")
+		return echo.NewHTTPError(http.StatusForbidden, "merchant public key is not configured")
+	}
+
+	if err := epay.NewEpaySignValidator(key).Validate(values); err != nil {
+		log.Error().Err(err).Int("pid", pid).Msg("Failed to validate Epay V2 signature")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	log.Debug().Int("pid", pid).Msg("Epay V2 signature validated successfully")
+	return nil
+}
+
+// signEpayV2Values signs V2 parameters with the platform private key
+func signEpayV2Values(values url.Values) error {
+	priv := platformPrivateKey()
+	if priv == nil {
+		log.Error().Msg("Epay V2 platform private key is not configured")
+		return errors.New("platform private key is not configured")
+	}
+
+	return epay.SignValues(values, &epay.SignKey{PrivateKey: priv})
+}
+
+// signEpayV2 returns the platform sign of a V2 reply
+func signEpayV2(msg interface{}) (string, error) {
+	values, err := epay.StructValues(msg)
+	if err != nil {
+		return "", err
+	}
+
+	if err := signEpayV2Values(values); err != nil {
+		return "", err
+	}
+	return values.Get("sign"), nil
+}
+
+// HandleEpayV2Create handles /api/pay/create of the V2 protocol
+func HandleEpayV2Create(c echo.Context) error {
+	log.Info().Str("env", epayEnv(c)).Msg("Handling Epay V2 create request")
+
+	var req epay.EpayV2CreateRequest
+	if err := (&echo.DefaultBinder{}).BindBody(c, &req); err != nil {
+		log.Error().Err(err).Msg("Failed to bind request body to EpayV2CreateRequest")
+		return epayApiError(c, echo.NewHTTPError(http.StatusBadRequest, err.Error()))
+	}
+
+	log.Debug().
+		Int("pid", req.Pid).
+		Str("method", req.Method).
+		Str("out_trade_no", req.OutTradeNo).
+		Str("money", req.Money).
+		Str("device", req.Device).
+		Msg("Received Epay V2 create parameters")
+
+	if err := verifyEpayV2Request(c, req.Pid); err != nil {
+		return epayApiError(c, err)
+	}
+
+	if req.Method != "" && req.Method != "web" && req.Method != "jump" {
+		return epayApiError(c, echo.NewHTTPError(http.StatusBadRequest, "unsupported method"))
+	}
+
+	if err := checkPayType(epayEnv(c), req.Pid, req.Type); err != nil {
+		return epayApiError(c, err)
+	}
+
+	client, err := newEnvAlipayClient(c)
+	if err != nil {
+		return epayApiError(c, err)
+	}
+
+	// method=jump always wants a URL to send the buyer to
+	method := resolvePayMethod(req.Device, "")
+	if req.Method == "jump" && method == payMethodQRCode {
+		method = payMethodPage
+	}
+
+	s, err := newEpaySubmission(client, epayEnv(c), req.ToSubmitRequest(), 2, method)
+	if err != nil {
+		return epayApiError(c, err)
+	}
+
+	payment, err := s.pay(c.Request().Context())
+	if err != nil {
+		return epayApiError(c, err)
+	}
+
+	resp := epay.EpayV2CreateResponse{
+		Code:    epay.EpayV2CodeSuccess,
+		Msg:     "success",
+		TradeNo: s.TradeNo,
+		PayType: "jump",
+		PayInfo: payment.PayUrl,
+	}
+	if payment.QRCode != "" {
+		resp.PayType = "qrcode"
+		resp.PayInfo = payment.QRCode
+	}
+
+	resp.Timestamp = epay.NewTimestamp()
+	resp.SignType = epayV2SignType
+	if resp.Sign, err = signEpayV2(&resp); err != nil {
+		return epayApiError(c, err)
+	}
+
+	log.Info().
+		Str("out_trade_no", req.OutTradeNo).
+		Str("pay_type", resp.PayType).
+		Str("pay_info", resp.PayInfo).
+		Msg("Replying to Epay V2 create request")
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// bindEpayV2Query binds and verifies a V2 query or refund request
+func bindEpayV2Query(c echo.Context) (*epay.EpayV2QueryRequest, error) {
+	var req epay.EpayV2QueryRequest
+	if err := (&echo.DefaultBinder{}).BindBody(c, &req); err != nil {
+		log.Error().Err(err).Msg("Failed to bind request body to EpayV2QueryRequest")
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	log.Info().
+		Int("pid", req.Pid).
+		Str("trade_no", req.TradeNo).
+		Str("out_trade_no", req.OutTradeNo).
+		Msg("Handling Epay V2 query request")
+
+	if err := verifyEpayV2Request(c, req.Pid); err != nil {
+		return nil, err
+	}
+
+	return &req, nil
+}
+
+// HandleEpayV2Query handles /api/pay/query of the V2 protocol
+func HandleEpayV2Query(c echo.Context) error {
+	req, err := bindEpayV2Query(c)
+	if err != nil {
+		return epayApiError(c, err)
+	}
+
+	apiReq := req.ToApiRequest()
+	_, rsp, carrier, err := queryMerchantTrade(c, &apiReq)
+	if err != nil {
+		return epayApiError(c, err)
+	}
+
+	order, err := buildOrderResponse(c.Request().Context(), rsp, carrier)
+	if err != nil {
+		return epayApiError(c, err)
+	}
+	resp := epay.EpayV2QueryResponse{
+		Code:       epay.EpayV2CodeSuccess,
+		Msg:        order.Msg,
+		TradeNo:    order.TradeNo,
+		OutTradeNo: order.OutTradeNo,
+		ApiTradeNo: order.ApiTradeNo,
+		Type:       order.Type,
+		Status:     order.Status,
+		Pid:        order.Pid,
+		Addtime:    order.Addtime,
+		Endtime:    order.Endtime,
+		Name:       order.Name,
+		Money:      order.Money,
+		Param:      order.Param,
+		Buyer:      order.Buyer,
+		Timestamp:  epay.NewTimestamp(),
+		SignType:   epayV2SignType,
+	}
+	if resp.Sign, err = signEpayV2(&resp); err != nil {
+		return epayApiError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// HandleEpayV2Refund handles /api/pay/refund of the V2 protocol
+func HandleEpayV2Refund(c echo.Context) error {
+	req, err := bindEpayV2Query(c)
+	if err != nil {
+		return epayApiError(c, err)
+	}
+
+	apiReq := req.ToApiRequest()
+	refund, err := refundMerchantTrade(c, &apiReq)
+	if err != nil {
+		return epayApiError(c, err)
+	}
+
+	resp := epay.EpayV2RefundResponse{
+		Code:        epay.EpayV2CodeSuccess,
+		Msg:         "退款成功",
+		TradeNo:     refund.TradeNo,
+		OutRefundNo: refund.OutRefundNo,
+		Money:       req.Money,
+		Timestamp:   epay.NewTimestamp(),
+		SignType:    epayV2SignType,
+	}
+	if resp.Sign, err = signEpayV2(&resp); err != nil {
+		return epayApiError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,328 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/smartwalle/alipay/v3"
+	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/misc"
+	"github.com/yiffyi/epay-fwd/notify"
+	"github.com/yiffyi/epay-fwd/store"
+)
+
+const (
+	minOrderTimeout = time.Minute
+	maxOrderTimeout = 15 * 24 * time.Hour // the longest Alipay accepts
+
+	sweepBatch = 100
+
+	sweepRetryDelay    = time.Minute // after the first failure to close an order
+	sweepMaxRetryDelay = 6 * time.Hour
+)
+
+// parseTimeoutExpress parses an Alipay style timeout_express such as 30m, 2h
+// or 1d. 1c (until midnight) is not supported.
+func parseTimeoutExpress(s string) (time.Duration, error) {
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid timeout_express %q", s)
+	}
+
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid timeout_express %q", s)
+	}
+
+	switch s[len(s)-1] {
+	case 'm':
+		return time.Duration(n) * time.Minute, nil
+	case 'h':
+		return time.Duration(n) * time.Hour, nil
+	case 'd':
+		return time.Duration(n) * 24 * time.Hour, nil
+	default:
+		return 0, fmt.Errorf("invalid timeout_express %q", s)
+	}
+}
+
+// orderTimeout returns how long the buyer has to pay an order of pid: the
+// timeout_express of the submit, else merchants.<pid>.order_timeout, else
+// order.timeout. Zero leaves it to Alipay.
+func orderTimeout(pid int, requested string) (time.Duration, error) {
+	var timeout time.Duration
+	if requested != "" {
+		d, err := parseTimeoutExpress(requested)
+		if err != nil {
+			return 0, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		timeout = d
+	} else if key := misc.MerchantConfigKey(pid, "order_timeout"); viper.IsSet(key) {
+		timeout = viper.GetDuration(key)
+	} else {
+		timeout = viper.GetDuration("order.timeout")
+	}
+
+	if timeout == 0 {
+		return 0, nil
+	}
+	if timeout < minOrderTimeout || timeout > maxOrderTimeout {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "timeout_express must be between 1m and 15d")
+	}
+	return timeout, nil
+}
+
+// applyExpiry tells Alipay when the trade expires, both as time_expire and as
+// the timeout_express left, for products only knowing the latter
+func applyExpiry(trade *alipay.Trade, expiresAt time.Time) {
+	if expiresAt.IsZero() {
+		return
+	}
+
+	minutes := int(time.Until(expiresAt) / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	trade.TimeoutExpress = strconv.Itoa(minutes) + "m"
+	trade.TimeExpire = expiresAt.In(alipayLocation).Format(alipayTimeLayout)
+}
+
+// alipayOutTradeNo is the out_trade_no Alipay knows an order by
+func alipayOutTradeNo(order *store.Order) string {
+	if order.TradeNo != "" {
+		return order.TradeNo
+	}
+	return order.OutTradeNo
+}
+
+// SetupOrderSweeper starts closing orders whose payment timeout has passed,
+// every order.sweep_interval
+func SetupOrderSweeper() {
+	interval := viper.GetDuration("order.sweep_interval")
+	if interval <= 0 {
+		log.Info().Msg("Order sweeper is disabled")
+		return
+	}
+
+	log.Info().Dur("interval", interval).Msg("Starting order sweeper")
+	sweeper := newOrderSweeper()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sweeper.sweep(context.Background(), time.Now())
+		}
+	}()
+}
+
+type sweepFailure struct {
+	failures int
+	retryAt  time.Time
+}
+
+// orderSweeper closes expired orders, those expired longest ago first. An
+// order it fails to close is left out of the following sweeps for a delay
+// doubling with every failure, so that orders Alipay keeps refusing to close
+// cannot hold up the others.
+type orderSweeper struct {
+	batch int // orders closed per sweep at most
+
+	mu     sync.Mutex
+	failed map[int64]*sweepFailure
+}
+
+func newOrderSweeper() *orderSweeper {
+	return &orderSweeper{batch: sweepBatch, failed: make(map[int64]*sweepFailure)}
+}
+
+// sweep closes a batch of expired orders still waiting for payment
+func (s *orderSweeper) sweep(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var backingOff []int64
+	for id, f := range s.failed {
+		if now.Before(f.retryAt) {
+			backingOff = append(backingOff, id)
+		}
+	}
+
+	orders, err := store.Orders().ListOrders(ctx, store.OrderFilter{
+		Status:        store.OrderCreated,
+		ExpiredBefore: now,
+		ExcludeIDs:    backingOff,
+		Limit:         s.batch,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list expired orders")
+		return
+	}
+
+	listed := make(map[int64]bool, len(orders))
+	for _, order := range orders {
+		listed[order.ID] = true
+		if err := closeExpiredOrder(ctx, order); err != nil {
+			f := s.failed[order.ID]
+			if f == nil {
+				f = &sweepFailure{}
+				s.failed[order.ID] = f
+			}
+			f.failures++
+			f.retryAt = now.Add(sweepBackoff(f.failures))
+
+			log.Error().
+				Err(err).
+				Int("pid", order.Pid).
+				Str("out_trade_no", order.OutTradeNo).
+				Int("failures", f.failures).
+				Time("retry_at", f.retryAt).
+				Msg("Failed to close expired order")
+			continue
+		}
+		delete(s.failed, order.ID)
+	}
+
+	// Every expired order due was listed, those missing left the created
+	// status some other way
+	if len(orders) < s.batch {
+		for id, f := range s.failed {
+			if !now.Before(f.retryAt) && !listed[id] {
+				delete(s.failed, id)
+			}
+		}
+	}
+}
+
+// sweepBackoff is how long an order is left alone after failing to close
+// failures times in a row
+func sweepBackoff(failures int) time.Duration {
+	delay := sweepRetryDelay
+	for i := 1; i < failures && delay < sweepMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, sweepMaxRetryDelay)
+}
+
+// closeExpiredOrder closes an expired order at Alipay and marks it closed. An
+// order that turns out to be paid is reconciled instead, its notification may
+// have been lost.
+func closeExpiredOrder(ctx context.Context, order *store.Order) error {
+	client, err := newAlipayClientForEnv(order.Env)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := client.TradeClose(ctx, alipay.TradeClose{OutTradeNo: alipayOutTradeNo(order)})
+	if err != nil {
+		return fmt.Errorf("failed to close alipay trade: %w", err)
+	}
+
+	// Trades the buyer never opened do not exist at Alipay, closing those is ours alone
+	if rsp.Code.IsFailure() && rsp.SubCode != "ACQ.TRADE_NOT_EXIST" {
+		trade, err := client.TradeQuery(ctx, alipay.TradeQuery{OutTradeNo: alipayOutTradeNo(order)})
+		if err != nil {
+			return fmt.Errorf("failed to query alipay trade: %w", err)
+		}
+		if trade.Code.IsSuccess() && isTradePaid(trade.TradeStatus) {
+			return reconcilePaidOrder(ctx, order, trade)
+		}
+		if trade.Code.IsFailure() || trade.TradeStatus != alipay.TradeStatusClosed {
+			log.Warn().
+				Str("out_trade_no", order.OutTradeNo).
+				Str("sub_code", rsp.SubCode).
+				Str("trade_status", string(trade.TradeStatus)).
+				Msg("Alipay did not close expired order")
+			return errors.New(rsp.SubMsg)
+		}
+	}
+
+	closed, err := store.Orders().UpdateOrder(ctx, order.Pid, order.OutTradeNo, store.OrderUpdate{
+		Status: store.OrderClosed,
+		Source: "sweeper",
+		Detail: "expired at " + order.ExpiresAt.Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Int("pid", order.Pid).
+		Str("out_trade_no", order.OutTradeNo).
+		Msg("Closed expired order")
+
+	if notifyClose(order.Pid) {
+		notifyOrderClosed(closed)
+	}
+	return nil
+}
+
+// reconcilePaidOrder catches up on an order found paid while closing it, as
+// its Alipay notification would have: the order is marked paid and the
+// merchant notified, unless the trade does not match the order.
+func reconcilePaidOrder(ctx context.Context, order *store.Order, trade *alipay.TradeQueryRsp) error {
+	log.Warn().
+		Int("pid", order.Pid).
+		Str("out_trade_no", order.OutTradeNo).
+		Str("trade_status", string(trade.TradeStatus)).
+		Msg("Expired order was paid, reconciling it")
+
+	notification := tradeNotification(trade)
+	carrier := orderCarrier(order)
+	if err := checkOrder(notification, order, ""); err != nil {
+		return quarantineOrder(ctx, carrier, order, notification, err)
+	}
+
+	if err := updateOrder(ctx, order, notification, ""); err != nil {
+		return err
+	}
+
+	tradeStatus := mapTradeStatus(order.Pid, string(trade.TradeStatus))
+	if tradeStatus == "" {
+		return nil
+	}
+
+	// Should the notification arrive after all, it maps to the same job
+	job := newNotifyJob(notification, carrier, tradeStatus, "")
+	if err := notify.Enqueue(job); err != nil && !errors.Is(err, notify.ErrJobExists) {
+		log.Error().Err(err).Str("out_trade_no", order.OutTradeNo).Msg("Failed to enqueue payment notification")
+		return err
+	}
+	return nil
+}
+
+// notifyClose tells whether merchants.<pid>.notify_close or order.notify_close
+// asks for expired orders to be notified
+func notifyClose(pid int) bool {
+	if key := misc.MerchantConfigKey(pid, "notify_close"); viper.IsSet(key) {
+		return viper.GetBool(key)
+	}
+	return viper.GetBool("order.notify_close")
+}
+
+// notifyOrderClosed tells the merchant that an order was closed, like a close
+// notification from Alipay would. Both end up as the same job.
+func notifyOrderClosed(order *store.Order) {
+	tradeStatus := mapTradeStatus(order.Pid, string(alipay.TradeStatusClosed))
+	if tradeStatus == "" {
+		return
+	}
+
+	notification := &alipay.Notification{
+		TradeNo:     order.ApiTradeNo,
+		OutTradeNo:  alipayOutTradeNo(order),
+		TradeStatus: alipay.TradeStatusClosed,
+		Subject:     order.Name,
+		TotalAmount: order.Money,
+	}
+
+	job := newNotifyJob(notification, orderCarrier(order), tradeStatus, notifyTypeClose)
+	if err := notify.Enqueue(job); err != nil && !errors.Is(err, notify.ErrJobExists) {
+		log.Error().Err(err).Str("out_trade_no", order.OutTradeNo).Msg("Failed to enqueue close notification")
+	}
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/epay"
+	"github.com/yiffyi/epay-fwd/store"
+)
+
+func TestSweepBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := sweepBackoff(tt.failures); got != tt.want {
+			t.Errorf("sweepBackoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+// Orders failing to close must not keep the sweeper from the others
+func TestSweepBacksOffFailingOrders(t *testing.T) {
+	orders := setupTestStore(t)
+	// Production orders cannot be closed while production is disabled
+	viper.Set("alipay.enable_production", false)
+
+	now := time.Now()
+	var created []*store.Order
+	for i, no := range []string{"O1", "O2", "O3"} {
+		order := &store.Order{Pid: 1001, OutTradeNo: no, TradeNo: "T" + no, Env: "prod", Type: "alipay", Name: "VIP",
+			Money: "1.00", NotifyUrl: "https://shop.example.com/notify.php", PayMethod: payMethodPage,
+			ExpiresAt: now.Add(time.Duration(i-10) * time.Minute)}
+		if err := orders.CreateOrder(t.Context(), order); err != nil {
+			t.Fatalf("CreateOrder() error = %v", err)
+		}
+		created = append(created, order)
+	}
+
+	s := newOrderSweeper()
+	s.batch = 2
+	failures := func() []int {
+		var n []int
+		for _, order := range created {
+			if f := s.failed[order.ID]; f != nil {
+				n = append(n, f.failures)
+			} else {
+				n = append(n, 0)
+			}
+		}
+		return n
+	}
+	check := func(want ...int) {
+		t.Helper()
+		got := failures()
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("failures = %v, want %v", got, want)
+			}
+		}
+	}
+
+	// The orders expired longest ago come first
+	s.sweep(t.Context(), now)
+	check(1, 1, 0)
+
+	// They are left alone for a minute, the next one gets its turn
+	s.sweep(t.Context(), now.Add(30*time.Second))
+	check(1, 1, 1)
+	s.sweep(t.Context(), now.Add(50*time.Second))
+	check(1, 1, 1)
+
+	s.sweep(t.Context(), now.Add(time.Minute))
+	check(2, 2, 1)
+	if f := s.failed[created[0].ID]; !f.retryAt.Equal(now.Add(3 * time.Minute)) {
+		t.Errorf("retrying at %v, want 2m after the second failure", f.retryAt)
+	}
+
+	// An order paid in the meantime is forgotten once due again
+	if _, err := orders.UpdateOrder(t.Context(), 1001, "O3", store.OrderUpdate{Status: store.OrderPaid}); err != nil {
+		t.Fatalf("UpdateOrder() error = %v", err)
+	}
+	s.sweep(t.Context(), now.Add(2*time.Minute))
+	if _, ok := s.failed[created[2].ID]; ok {
+		t.Error("sweeper still tracks a paid order")
+	}
+	check(2, 2, 0)
+}
+
+func TestParseTimeoutExpress(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"1m", time.Minute, false},
+		{"90m", 90 * time.Minute, false},
+		{"2h", 2 * time.Hour, false},
+		{"15d", 15 * 24 * time.Hour, false},
+		{"1c", 0, true},
+		{"0m", 0, true},
+		{"-5m", 0, true},
+		{"m", 0, true},
+		{"", 0, true},
+		{"30", 0, true},
+		{"30s", 0, true},
+		{"1.5h", 0, true},
+		{" 5m", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parseTimeoutExpress(tt.s)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("parseTimeoutExpress(%q) = %v, %v, want %v, error %v", tt.s, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOrderTimeout(t *testing.T) {
+	t.Cleanup(func() {
+		viper.Set("order.timeout", nil)
+		viper.Set("merchants.1001.order_timeout", nil)
+	})
+
+	tests := []struct {
+		name      string
+		global    string
+		merchant  string // not set if empty
+		requested string
+		want      time.Duration
+		wantErr   bool
+	}{
+		{"left to alipay", "0s", "", "", 0, false},
+		{"global", "30m", "", "", 30 * time.Minute, false},
+		{"merchant", "30m", "2h", "", 2 * time.Hour, false},
+		{"merchant leaves it to alipay", "30m", "0s", "", 0, false},
+		{"requested", "30m", "2h", "10m", 10 * time.Minute, false},
+		{"shortest", "0s", "", "1m", time.Minute, false},
+		{"longest", "0s", "", "15d", 15 * 24 * time.Hour, false},
+		{"requested too long", "0s", "", "16d", 0, true},
+		{"requested in hours too long", "0s", "", "361h", 0, true},
+		{"requested invalid", "30m", "", "1c", 0, true},
+		{"global too short", "30s", "", "", 0, true},
+		{"merchant too long", "30m", "400h", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("order.timeout", tt.global)
+			viper.Set("merchants.1001.order_timeout", nil)
+			if tt.merchant != "" {
+				viper.Set("merchants.1001.order_timeout", tt.merchant)
+			}
+
+			got, err := orderTimeout(1001, tt.requested)
+			if tt.wantErr {
+				var he *echo.HTTPError
+				if !errors.As(err, &he) || he.Code != http.StatusBadRequest {
+					t.Errorf("orderTimeout() = %v, %v, want a bad request", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("orderTimeout() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// The timeout reaches Alipay as time_expire and timeout_express
+func TestSubmitTimeoutExpress(t *testing.T) {
+	setupTestStore(t)
+	setupTestAlipay(t)
+	viper.Set("site_url", "https://pay.example.com")
+	viper.Set("epay.types", []string{"alipay"})
+
+	e := echo.New()
+	SetupEpayEndpoints(e.Group("/epay"))
+
+	param := epay.EpaySubmitRequest{Pid: 1001, Type: "alipay", OutTradeNo: "O1", NotifyUrl: "https://shop.example.com/notify.php",
+		Name: "VIP", Money: "1.00", Timeout: "2h"}
+	before := time.Now()
+	resp := submitMapi(t, e, param)
+	if resp.Code != epay.EpayCodeSuccess {
+		t.Fatalf("submit = %+v", resp)
+	}
+
+	payURL, err := url.Parse(resp.PayUrl)
+	if err != nil {
+		t.Fatalf("invalid pay url: %v", err)
+	}
+	var content struct {
+		TimeExpire     string `json:"time_expire"`
+		TimeoutExpress string `json:"timeout_express"`
+	}
+	if err := json.Unmarshal([]byte(payURL.Query().Get("biz_content")), &content); err != nil {
+		t.Fatalf("invalid biz_content: %v", err)
+	}
+	if content.TimeoutExpress != "119m" && content.TimeoutExpress != "120m" {
+		t.Errorf("timeout_express = %s", content.TimeoutExpress)
+	}
+	expire, err := time.ParseInLocation(alipayTimeLayout, content.TimeExpire, alipayLocation)
+	if err != nil || expire.Before(before.Add(2*time.Hour).Truncate(time.Second)) || expire.After(time.Now().Add(2*time.Hour)) {
+		t.Errorf("time_expire = %s, %v", content.TimeExpire, err)
+	}
+
+	order, err := store.Orders().GetOrder(t.Context(), 1001, "O1")
+	if err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+	if !order.ExpiresAt.Truncate(time.Second).Equal(expire) {
+		t.Errorf("order expires at %v, Alipay at %v", order.ExpiresAt, expire)
+	}
+
+	param.OutTradeNo, param.Timeout = "O2", "30d"
+	if resp := submitMapi(t, e, param); resp.Code != epay.EpayCodeFailure || !strings.Contains(resp.Msg, "between 1m and 15d") {
+		t.Errorf("submit with timeout_express 30d = %+v", resp)
+	}
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/yiffyi/epay-fwd/epay"
+	"github.com/yiffyi/epay-fwd/notify"
+)
+
+const (
+	merchantNotifyLogLimit = 50
+	adminNotifyLogLimit    = 200
+)
+
+// buildNotifyLogs describes notify jobs without their signed parameters, in
+// China time like every other time of the epay API
+func buildNotifyLogs(jobs []*notify.Job) []epay.EpayNotifyLog {
+	logs := make([]epay.EpayNotifyLog, 0, len(jobs))
+	for _, job := range jobs {
+		entry := epay.EpayNotifyLog{
+			Pid:         job.Pid,
+			TradeNo:     job.TradeNo,
+			OutTradeNo:  job.OutTradeNo,
+			TradeStatus: job.TradeStatus,
+			NotifyType:  job.Params.Get("notify_type"),
+			State:       string(job.State),
+			Addtime:     job.CreatedAt.In(alipayLocation).Format(alipayTimeLayout),
+			Attempts:    make([]epay.EpayNotifyAttempt, 0, len(job.Attempts)),
+		}
+		if job.State == notify.JobPending {
+			entry.Nexttime = job.NextAt.In(alipayLocation).Format(alipayTimeLayout)
+		}
+
+		for _, a := range job.Attempts {
+			entry.Attempts = append(entry.Attempts, epay.EpayNotifyAttempt{
+				Time:      a.At.In(alipayLocation).Format(alipayTimeLayout),
+				Method:    a.Method,
+				Url:       a.URL,
+				Status:    a.Status,
+				Response:  a.Body,
+				Error:     a.Error,
+				LatencyMs: a.LatencyMs,
+			})
+		}
+		logs = append(logs, entry)
+	}
+	return logs
+}
+
+// handleEpayApiNotifyLog answers act=notify_log with the delivery history of
+// the merchant's notifications, of one order if trade_no or out_trade_no is given
+func handleEpayApiNotifyLog(c echo.Context, req *epay.EpayApiRequest) error {
+	jobs, err := notify.History(notify.JobFilter{
+		Pid:        req.Pid,
+		TradeNo:    req.TradeNo,
+		OutTradeNo: req.OutTradeNo,
+		Limit:      merchantNotifyLogLimit,
+	})
+	if err != nil {
+		log.Error().Err(err).Int("pid", req.Pid).Msg("Failed to query notify history")
+		return epayApiError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, epay.EpayNotifyLogResponse{
+		Code: epay.EpayCodeSuccess,
+		Msg:  "success",
+		Data: buildNotifyLogs(jobs),
+	})
+}
+
+type AdminNotifyLogResponse struct {
+	Logs []epay.EpayNotifyLog `json:"logs"`
+}
+
+// HandleAdminNotifyLog returns the delivery history of notifications, filtered
+// by the pid, trade_no and out_trade_no query parameters
+func HandleAdminNotifyLog(c echo.Context) error {
+	filter := notify.JobFilter{
+		TradeNo:    c.QueryParam("trade_no"),
+		OutTradeNo: c.QueryParam("out_trade_no"),
+		Limit:      adminNotifyLogLimit,
+	}
+
+	if s := c.QueryParam("pid"); s != "" {
+		pid, err := strconv.Atoi(s)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid pid")
+		}
+		filter.Pid = pid
+	}
+	if s := c.QueryParam("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
+		}
+		filter.Limit = limit
+	}
+
+	jobs, err := notify.History(filter)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to query notify history")
+		return err
+	}
+
+	return c.JSON(http.StatusOK, AdminNotifyLogResponse{Logs: buildNotifyLogs(jobs)})
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/yiffyi/epay-fwd/notify"
+)
+
+func TestBuildNotifyLogsTimes(t *testing.T) {
+	at := time.Date(2024, 1, 2, 20, 4, 5, 0, time.UTC)
+	jobs := []*notify.Job{{
+		Pid:       1001,
+		State:     notify.JobPending,
+		Params:    url.Values{"sign": {"0123456789abcdef"}},
+		CreatedAt: at,
+		NextAt:    at.Add(time.Hour),
+		Attempts:  []notify.Attempt{{At: at.Add(time.Minute), Error: "timeout"}},
+	}}
+
+	logs := buildNotifyLogs(jobs)
+	if len(logs) != 1 || len(logs[0].Attempts) != 1 {
+		t.Fatalf("buildNotifyLogs() = %+v", logs)
+	}
+	// Times are in China time whatever the server's time zone
+	if got := logs[0]; got.Addtime != "2024-01-03 04:04:05" || got.Nexttime != "2024-01-03 05:04:05" || got.Attempts[0].Time != "2024-01-03 04:05:05" {
+		t.Errorf("buildNotifyLogs() times = %s, %s, %s", got.Addtime, got.Nexttime, got.Attempts[0].Time)
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"strings"
+
+	"github.com/smartwalle/alipay/v3"
+	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/misc"
+)
+
+const (
+	notifyTypeRefund = "refund" // part or all of a paid trade was refunded
+	notifyTypeClose  = "close"  // an unpaid trade was closed
+
+	// refundStatusKey is the status map key of refund notifications, which
+	// Alipay sends with the status of the trade after the refund
+	refundStatusKey = "REFUND"
+)
+
+// classifyNotification tells refunds and closes apart from payments. It
+// returns the epay notify_type and the key to look the status up with.
+func classifyNotification(notification *alipay.Notification) (notifyType string, statusKey string) {
+	switch {
+	case notification.GmtRefund != "" || notification.OutBizNo != "" && notification.RefundFee != "":
+		return notifyTypeRefund, refundStatusKey
+	case notification.TradeStatus == alipay.TradeStatusClosed:
+		return notifyTypeClose, string(notification.TradeStatus)
+	default:
+		return "", string(notification.TradeStatus)
+	}
+}
+
+// defaultStatusMap is used for statuses neither notify.status_map nor the
+// merchant's status_map mention. WAIT_BUYER_PAY is not forwarded.
+var defaultStatusMap = map[string]string{
+	"trade_success":  "TRADE_SUCCESS",
+	"trade_finished": "TRADE_SUCCESS",
+	"trade_closed":   "TRADE_CLOSED",
+	"refund":         "TRADE_REFUND",
+}
+
+// mapTradeStatus returns the epay trade_status forwarded for an Alipay status
+// key, from merchants.<pid>.status_map, notify.status_map or the defaults. An
+// empty result means the status is not forwarded at all.
+func mapTradeStatus(pid int, statusKey string) string {
+	key := strings.ToLower(statusKey) // viper keys are case insensitive
+	for _, m := range []string{misc.MerchantConfigKey(pid, "status_map"), "notify.status_map"} {
+		if status, ok := viper.GetStringMapString(m)[key]; ok {
+			return status
+		}
+	}
+	return defaultStatusMap[key]
+}
+
+// transition names the state change a notification reports, refunds by their
+// refund request so that each partial refund is told once
+func transition(notifyType, tradeStatus string, notification *alipay.Notification) string {
+	if notifyType == notifyTypeRefund {
+		return tradeStatus + "-" + notification.OutBizNo
+	}
+	return tradeStatus
+}
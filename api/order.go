@@ -0,0 +1,317 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/smartwalle/alipay/v3"
+	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/alert"
+	"github.com/yiffyi/epay-fwd/epay"
+	"github.com/yiffyi/epay-fwd/store"
+)
+
+// alipayTimeLayout is how Alipay formats times such as gmt_payment, in China
+// Standard Time
+const alipayTimeLayout = "2006-01-02 15:04:05"
+
+var alipayLocation = time.FixedZone("CST", 8*60*60)
+
+// findOrder returns the stored order, or nil for orders submitted before the
+// store existed
+func findOrder(ctx context.Context, pid int, outTradeNo string) (*store.Order, error) {
+	orders := store.Orders()
+	if orders == nil {
+		return nil, errors.New("order store is not set up")
+	}
+
+	order, err := orders.GetOrder(ctx, pid, outTradeNo)
+	if errors.Is(err, store.ErrOrderNotFound) {
+		log.Warn().Int("pid", pid).Str("out_trade_no", outTradeNo).Msg("Order is not in the order store")
+		return nil, nil
+	} else if err != nil {
+		log.Error().Err(err).Int("pid", pid).Str("out_trade_no", outTradeNo).Msg("Failed to load order")
+		return nil, err
+	}
+	return order, nil
+}
+
+// alipayTradeQuery names an epay order for Alipay. Our trade_no is the
+// out_trade_no at Alipay, and the merchant's out_trade_no is translated through
+// the order store. Orders missing from the store were submitted with the
+// merchant's number and reported the Alipay trade_no as theirs; no stored
+// order is returned for them.
+func alipayTradeQuery(ctx context.Context, pid int, tradeNo, outTradeNo string) (alipay.TradeQuery, *store.Order, error) {
+	orders := store.Orders()
+	if orders == nil {
+		return alipay.TradeQuery{}, nil, errors.New("order store is not set up")
+	}
+
+	if tradeNo != "" {
+		order, err := orders.GetOrderByTradeNo(ctx, tradeNo)
+		if errors.Is(err, store.ErrOrderNotFound) {
+			return alipay.TradeQuery{TradeNo: tradeNo}, nil, nil
+		} else if err != nil {
+			log.Error().Err(err).Str("trade_no", tradeNo).Msg("Failed to load order")
+			return alipay.TradeQuery{}, nil, err
+		}
+		return alipay.TradeQuery{OutTradeNo: tradeNo}, order, nil
+	}
+
+	order, err := findOrder(ctx, pid, outTradeNo)
+	if err != nil {
+		return alipay.TradeQuery{}, nil, err
+	}
+	if order != nil && order.TradeNo != "" {
+		return alipay.TradeQuery{OutTradeNo: order.TradeNo}, order, nil
+	}
+	return alipay.TradeQuery{OutTradeNo: outTradeNo}, order, nil
+}
+
+// findTradeOrder returns the stored order of pid that Alipay knows by
+// alipayOutTradeNo: our trade_no, or the merchant's out_trade_no for orders
+// from before trade_no existed. It is nil for orders missing from the store.
+func findTradeOrder(ctx context.Context, pid int, alipayOutTradeNo string) (*store.Order, error) {
+	orders := store.Orders()
+	if orders == nil {
+		return nil, errors.New("order store is not set up")
+	}
+
+	order, err := orders.GetOrderByTradeNo(ctx, alipayOutTradeNo)
+	if err == nil {
+		if order.Pid != pid {
+			return nil, fmt.Errorf("order %s is not of merchant %d", alipayOutTradeNo, pid)
+		}
+		return order, nil
+	} else if !errors.Is(err, store.ErrOrderNotFound) {
+		log.Error().Err(err).Str("trade_no", alipayOutTradeNo).Msg("Failed to load order")
+		return nil, err
+	}
+
+	order, err = findOrder(ctx, pid, alipayOutTradeNo)
+	if err != nil || order == nil || order.TradeNo != "" {
+		return nil, err
+	}
+	return order, nil
+}
+
+// tradeCarrier returns what the merchant submitted with the order of an Alipay
+// trade, and the stored order. passback_params carries the pid of the order.
+// Orders from before carry everything there, in an encoded param carrier,
+// which is used for those missing from the store.
+func tradeCarrier(ctx context.Context, alipayOutTradeNo, passbackParams string) (*epay.ParamCarrier, *store.Order, error) {
+	var legacy *epay.ParamCarrier
+	pid, err := strconv.Atoi(passbackParams)
+	if err != nil {
+		legacy, err = epay.DecodeParamCarrier(passbackParams)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to decode param carrier from passback params")
+			return nil, nil, err
+		}
+		pid = legacy.Pid
+	}
+
+	order, err := findTradeOrder(ctx, pid, alipayOutTradeNo)
+	if err != nil {
+		return nil, nil, err
+	}
+	if order != nil {
+		return orderCarrier(order), order, nil
+	}
+	if legacy == nil {
+		return nil, nil, fmt.Errorf("order %s of merchant %d is not in the order store", alipayOutTradeNo, pid)
+	}
+	return legacy, nil, nil
+}
+
+// orderCarrier returns the param carrier of a stored order. Orders from before
+// trade_no existed have no OutTradeNo in it, as Alipay knows them by the
+// merchant's number.
+func orderCarrier(order *store.Order) *epay.ParamCarrier {
+	carrier := &epay.ParamCarrier{
+		Pid:       order.Pid,
+		NotifyUrl: order.NotifyUrl,
+		Param:     order.Param,
+		Env:       order.Env,
+		Version:   order.Version,
+		SignType:  order.SignType,
+		PayMethod: order.PayMethod,
+	}
+	if order.TradeNo != "" {
+		carrier.OutTradeNo = order.OutTradeNo
+	}
+	return carrier
+}
+
+// orderEnv returns the environment a stored order was created in, or fallback
+// for orders missing from the store
+func orderEnv(order *store.Order, fallback string) string {
+	if order != nil && order.Env != "" {
+		return order.Env
+	}
+	return fallback
+}
+
+// sameAmount compares two decimal amounts, so that "1" matches "1.00"
+func sameAmount(a, b string) bool {
+	x, ok := new(big.Rat).SetString(a)
+	if !ok {
+		return false
+	}
+	y, ok := new(big.Rat).SetString(b)
+	if !ok {
+		return false
+	}
+	return x.Cmp(y) == 0
+}
+
+// checkAlipayApp makes sure a notification is about a trade of our app and,
+// if alipay.seller_id is set, paid to our seller account
+func checkAlipayApp(notification *alipay.Notification) error {
+	if appID := viper.GetString("alipay.app_id"); notification.AppId != appID {
+		return fmt.Errorf("app_id %s is not %s", notification.AppId, appID)
+	}
+	if sellerID := viper.GetString("alipay.seller_id"); sellerID != "" && notification.SellerId != sellerID {
+		return fmt.Errorf("seller_id %s is not %s", notification.SellerId, sellerID)
+	}
+	return nil
+}
+
+// checkOrder compares an Alipay trade with what the merchant signed when
+// submitting the order. receipt_amount is only compared for payments, with
+// alipay.check_receipt_amount, as discounts make it differ legitimately.
+func checkOrder(notification *alipay.Notification, order *store.Order, notifyType string) error {
+	if !sameAmount(notification.TotalAmount, order.Money) {
+		return fmt.Errorf("total_amount %s is not money %s", notification.TotalAmount, order.Money)
+	}
+	if notification.Subject != order.Name {
+		return fmt.Errorf("subject %q is not name %q", notification.Subject, order.Name)
+	}
+	if notifyType == "" && isTradePaid(notification.TradeStatus) && order.Status == store.OrderClosed {
+		return errors.New("trade was paid after the order was closed")
+	}
+	if notifyType == "" && notification.ReceiptAmount != "" && viper.GetBool("alipay.check_receipt_amount") &&
+		!sameAmount(notification.ReceiptAmount, order.Money) {
+		return fmt.Errorf("receipt_amount %s is not money %s", notification.ReceiptAmount, order.Money)
+	}
+	return nil
+}
+
+// quarantineNotification holds a notification that does not match its order
+// for review instead of forwarding it, see quarantineOrder. Alipay is
+// acknowledged, so that it stops notifying.
+func quarantineNotification(c echo.Context, carrier *epay.ParamCarrier, order *store.Order, notification *alipay.Notification, reason error) error {
+	if err := quarantineOrder(c.Request().Context(), carrier, order, notification, reason); err != nil {
+		return err
+	}
+	return c.String(http.StatusOK, "success")
+}
+
+// quarantineOrder holds an order whose Alipay trade does not match what the
+// merchant submitted, and alerts operators
+func quarantineOrder(ctx context.Context, carrier *epay.ParamCarrier, order *store.Order, notification *alipay.Notification, reason error) error {
+	tradeNo, outTradeNo := carrier.OrderNos(notification.TradeNo, notification.OutTradeNo)
+	log.Error().
+		Err(reason).
+		Int("pid", carrier.Pid).
+		Str("trade_no", tradeNo).
+		Str("out_trade_no", outTradeNo).
+		Str("notify_id", notification.NotifyId).
+		Msg("Alipay trade does not match the order")
+
+	if order != nil {
+		if order.Status == store.OrderQuarantined {
+			log.Info().Str("out_trade_no", order.OutTradeNo).Msg("Order is already quarantined")
+			return nil
+		}
+
+		_, err := store.Orders().UpdateOrder(ctx, order.Pid, order.OutTradeNo, store.OrderUpdate{
+			Status:           store.OrderQuarantined,
+			ApiTradeNo:       notification.TradeNo,
+			Buyer:            notification.BuyerLogonId,
+			QuarantineReason: reason.Error(),
+			Source:           "alipay_notify",
+			Detail:           notification.NotifyId,
+		})
+		if err != nil {
+			log.Error().Err(err).Str("out_trade_no", order.OutTradeNo).Msg("Failed to quarantine order")
+			return err
+		}
+	}
+
+	alert.Fire(&alert.Event{
+		Kind:    alert.KindQuarantine,
+		Pid:     carrier.Pid,
+		Summary: fmt.Sprintf("Notification of order %s to merchant %d was quarantined: %s", outTradeNo, carrier.Pid, reason),
+		Orders: []alert.Order{{
+			TradeNo:    tradeNo,
+			OutTradeNo: outTradeNo,
+			LastError:  reason.Error(),
+		}},
+	})
+	return nil
+}
+
+// orderUpdate turns an Alipay notification into the change of the order it
+// reports. An empty status means the order does not change status, such as
+// while waiting for the buyer.
+func orderUpdate(notification *alipay.Notification, notifyType string) store.OrderUpdate {
+	update := store.OrderUpdate{
+		ApiTradeNo: notification.TradeNo,
+		Buyer:      notification.BuyerLogonId,
+		Source:     "alipay_notify",
+		Detail:     notification.NotifyId,
+	}
+
+	switch {
+	case notifyType == notifyTypeRefund:
+		update.Status = store.OrderRefunded
+		update.RefundMoney = notification.RefundFee
+	case notifyType == notifyTypeClose:
+		update.Status = store.OrderClosed
+	case isTradePaid(notification.TradeStatus):
+		update.Status = store.OrderPaid
+		update.PaidAt = time.Now()
+		if t, err := time.ParseInLocation(alipayTimeLayout, notification.GmtPayment, alipayLocation); err == nil {
+			update.PaidAt = t
+		}
+	}
+	return update
+}
+
+// updateOrder records what an Alipay notification reports about an order.
+// Orders missing from the store are skipped, and so are status changes the
+// order is past, such as TRADE_FINISHED after a refund.
+func updateOrder(ctx context.Context, order *store.Order, notification *alipay.Notification, notifyType string) error {
+	if order == nil {
+		return nil
+	}
+
+	updated, err := store.Orders().UpdateOrder(ctx, order.Pid, order.OutTradeNo, orderUpdate(notification, notifyType))
+	if errors.Is(err, store.ErrInvalidTransition) {
+		log.Warn().
+			Err(err).
+			Int("pid", order.Pid).
+			Str("out_trade_no", order.OutTradeNo).
+			Str("trade_status", string(notification.TradeStatus)).
+			Msg("Ignoring order status change reported by Alipay")
+		return nil
+	} else if err != nil {
+		log.Error().Err(err).Int("pid", order.Pid).Str("out_trade_no", order.OutTradeNo).Msg("Failed to update order")
+		return err
+	}
+
+	log.Debug().
+		Int64("order_id", updated.ID).
+		Str("out_trade_no", updated.OutTradeNo).
+		Str("status", string(updated.Status)).
+		Msg("Updated order from Alipay notification")
+	return nil
+}
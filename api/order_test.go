@@ -0,0 +1,180 @@
+package api
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/smartwalle/alipay/v3"
+	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/epay"
+	"github.com/yiffyi/epay-fwd/store"
+)
+
+// setupTestStore opens a fresh order store for the package level helpers
+func setupTestStore(t *testing.T) store.OrderStore {
+	t.Helper()
+
+	viper.Set("store.path", filepath.Join(t.TempDir(), "epay-fwd.db"))
+	if err := store.Setup(); err != nil {
+		t.Fatalf("store.Setup() error = %v", err)
+	}
+	t.Cleanup(func() { store.Orders().Close() })
+	return store.Orders()
+}
+
+// createTestOrder stores an order of merchant 1001 in the given status
+func createTestOrder(t *testing.T, outTradeNo string, status store.OrderStatus) *store.Order {
+	t.Helper()
+
+	order := &store.Order{
+		Pid:        1001,
+		OutTradeNo: outTradeNo,
+		TradeNo:    "T" + outTradeNo,
+		Env:        "sandbox",
+		Type:       "alipay",
+		Name:       "VIP",
+		Money:      "1.00",
+		NotifyUrl:  "https://shop.example.com/notify.php",
+		PayMethod:  payMethodPage,
+		Version:    1,
+		Status:     status,
+	}
+	if err := store.Orders().CreateOrder(t.Context(), order); err != nil {
+		t.Fatalf("CreateOrder() error = %v", err)
+	}
+	return order
+}
+
+func TestUpdateOrderIgnoresStaleStatus(t *testing.T) {
+	orders := setupTestStore(t)
+
+	tests := []struct {
+		name         string
+		status       store.OrderStatus
+		notification alipay.Notification
+		notifyType   string
+		want         store.OrderStatus
+	}{
+		{"paid", store.OrderCreated, alipay.Notification{TradeStatus: alipay.TradeStatusSuccess}, "", store.OrderPaid},
+		{"finished after refund", store.OrderRefunded, alipay.Notification{TradeStatus: alipay.TradeStatusFinished}, "", store.OrderRefunded},
+		{"success repeated after refund", store.OrderRefunded, alipay.Notification{TradeStatus: alipay.TradeStatusSuccess}, "", store.OrderRefunded},
+		{"paid while quarantined", store.OrderQuarantined, alipay.Notification{TradeStatus: alipay.TradeStatusSuccess}, "", store.OrderQuarantined},
+		{"closed after payment", store.OrderPaid, alipay.Notification{TradeStatus: alipay.TradeStatusClosed}, notifyTypeClose, store.OrderPaid},
+		{"refund", store.OrderPaid, alipay.Notification{TradeStatus: alipay.TradeStatusSuccess, RefundFee: "0.50", OutBizNo: "R1"}, notifyTypeRefund, store.OrderRefunded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := createTestOrder(t, tt.name, tt.status)
+			notification := tt.notification
+			notification.Subject = order.Name
+			notification.TotalAmount = order.Money
+
+			if err := updateOrder(t.Context(), order, &notification, tt.notifyType); err != nil {
+				t.Fatalf("updateOrder() error = %v", err)
+			}
+
+			stored, err := orders.GetOrder(t.Context(), order.Pid, order.OutTradeNo)
+			if err != nil {
+				t.Fatalf("GetOrder() error = %v", err)
+			}
+			if stored.Status != tt.want {
+				t.Errorf("order is %s, want %s", stored.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckOrderPaidAfterClose(t *testing.T) {
+	order := &store.Order{Name: "VIP", Money: "1.00", Status: store.OrderClosed}
+	paid := &alipay.Notification{TradeStatus: alipay.TradeStatusSuccess, Subject: "VIP", TotalAmount: "1.00"}
+	if err := checkOrder(paid, order, ""); err == nil {
+		t.Error("checkOrder() accepted a payment of a closed order")
+	}
+
+	closed := &alipay.Notification{TradeStatus: alipay.TradeStatusClosed, Subject: "VIP", TotalAmount: "1.00"}
+	if err := checkOrder(closed, order, notifyTypeClose); err != nil {
+		t.Errorf("checkOrder() of a close error = %v", err)
+	}
+}
+
+func TestTradeCarrier(t *testing.T) {
+	setupTestStore(t)
+	order := createTestOrder(t, "O1", store.OrderCreated)
+
+	legacy := &epay.ParamCarrier{Pid: 1002, NotifyUrl: "https://legacy.example.com/notify.php", Param: "legacy"}
+	encoded, err := legacy.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	tests := []struct {
+		name             string
+		alipayOutTradeNo string
+		passbackParams   string
+		wantPid          int
+		wantOrder        bool
+		wantErr          bool
+	}{
+		{"stored order", order.TradeNo, "1001", 1001, true, false},
+		{"stored order of another merchant", order.TradeNo, "1002", 0, false, true},
+		{"missing order", "T404", "1001", 0, false, true},
+		{"legacy carrier", "LEGACY1", encoded, 1002, false, false},
+		{"legacy carrier of a stored order", order.TradeNo, func() string {
+			s, _ := (&epay.ParamCarrier{Pid: 1001, OutTradeNo: "O1"}).Encode()
+			return s
+		}(), 1001, true, false},
+		{"garbage", order.TradeNo, "not a carrier", 0, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			carrier, stored, err := tradeCarrier(t.Context(), tt.alipayOutTradeNo, tt.passbackParams)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("tradeCarrier() = %+v, want an error", carrier)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tradeCarrier() error = %v", err)
+			}
+			if carrier.Pid != tt.wantPid || (stored != nil) != tt.wantOrder {
+				t.Errorf("tradeCarrier() = pid %d, order %v", carrier.Pid, stored)
+			}
+			if stored != nil {
+				tradeNo, outTradeNo := carrier.OrderNos("2024ALIPAY", tt.alipayOutTradeNo)
+				if tradeNo != order.TradeNo || outTradeNo != "O1" || carrier.NotifyUrl != order.NotifyUrl || carrier.Env != "sandbox" {
+					t.Errorf("carrier of the stored order = %+v", carrier)
+				}
+			}
+		})
+	}
+}
+
+// A legacy order is known at Alipay by the merchant's out_trade_no
+func TestTradeCarrierLegacyStoredOrder(t *testing.T) {
+	orders := setupTestStore(t)
+	order := &store.Order{Pid: 1001, OutTradeNo: "M1", Env: "sandbox", Type: "alipay", Name: "VIP", Money: "1.00",
+		NotifyUrl: "https://shop.example.com/notify.php", PayMethod: payMethodPage}
+	if err := orders.CreateOrder(t.Context(), order); err != nil {
+		t.Fatalf("CreateOrder() error = %v", err)
+	}
+
+	carrier, stored, err := tradeCarrier(t.Context(), "M1", "1001")
+	if err != nil {
+		t.Fatalf("tradeCarrier() error = %v", err)
+	}
+	if stored == nil || stored.ID != order.ID {
+		t.Fatalf("tradeCarrier() found order %v", stored)
+	}
+	if tradeNo, outTradeNo := carrier.OrderNos("2024ALIPAY", "M1"); tradeNo != "2024ALIPAY" || outTradeNo != "M1" {
+		t.Errorf("OrderNos() = %s, %s", tradeNo, outTradeNo)
+	}
+
+	// Not an order of ours under the merchant's number once trade_no exists
+	createTestOrder(t, "O2", store.OrderCreated)
+	if _, _, err := tradeCarrier(t.Context(), "O2", "1001"); err == nil {
+		t.Error("tradeCarrier() found an order by its merchant out_trade_no")
+	}
+}
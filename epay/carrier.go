@@ -7,11 +7,29 @@ import (
 	"fmt"
 )
 
+// ParamCarrier is what the merchant submitted with an order that notifications
+// and returns need. It is rebuilt from the stored order; orders from before
+// the store carry it encoded in Alipay's passback_params.
 type ParamCarrier struct {
-	Pid       int
-	NotifyUrl string
-	Param     string
-	// EpayReturnUrl string
+	Pid        int
+	OutTradeNo string // merchant out_trade_no; Alipay knows the order by our trade_no
+	NotifyUrl  string
+	Param      string
+	Env        string // environment the order was created in
+	Version    int    // epay protocol version the order was submitted with, 0 or 1 for V1
+	SignType   string // sign_type the merchant submitted with, reused for notifications
+	PayMethod  string // Alipay product chosen for the order: page, wap or qrcode
+}
+
+// OrderNos translates the numbers of an Alipay trade into epay ones: our
+// trade_no, which Alipay knows as out_trade_no, and the merchant's
+// out_trade_no. Orders submitted before they were told apart were known to
+// Alipay by the merchant's number and keep reporting the Alipay trade_no.
+func (c *ParamCarrier) OrderNos(alipayTradeNo, alipayOutTradeNo string) (tradeNo, outTradeNo string) {
+	if c.OutTradeNo == "" {
+		return alipayTradeNo, alipayOutTradeNo
+	}
+	return alipayOutTradeNo, c.OutTradeNo
 }
 
 func DecodeParamCarrier(s string) (*ParamCarrier, error) {
@@ -5,33 +5,19 @@ import (
 	"net/url"
 )
 
-type EpaySignedRequest interface {
-	GetSign() string
-	GetSignType() string
-}
-
 type EpaySubmitRequest struct {
-	Pid        int    `json:"pid" form:"pid"`
-	Type       string `json:"type" form:"type"`
-	OutTradeNo string `json:"out_trade_no" form:"out_trade_no"`
-	NotifyUrl  string `json:"notify_url" form:"notify_url"`
-	ReturnUrl  string `json:"return_url" form:"return_url"`
-	Name       string `json:"name" form:"name"`
-	Money      string `json:"money" form:"money"`
-	Param      string `json:"param" form:"param"`
-	Device     string `json:"device" form:"device"`
-	Sign       string `json:"sign" form:"sign"`
-	SignType   string `json:"sign_type" form:"sign_type"`
-}
-
-// GetSign returns the sign value
-func (r *EpaySubmitRequest) GetSign() string {
-	return r.Sign
-}
-
-// GetSignType returns the sign type
-func (r *EpaySubmitRequest) GetSignType() string {
-	return r.SignType
+	Pid        int    `json:"pid" query:"pid" form:"pid"`
+	Type       string `json:"type" query:"type" form:"type"`
+	OutTradeNo string `json:"out_trade_no" query:"out_trade_no" form:"out_trade_no"`
+	NotifyUrl  string `json:"notify_url" query:"notify_url" form:"notify_url"`
+	ReturnUrl  string `json:"return_url" query:"return_url" form:"return_url"`
+	Name       string `json:"name" query:"name" form:"name"`
+	Money      string `json:"money" query:"money" form:"money"`
+	Param      string `json:"param" query:"param" form:"param"`
+	Device     string `json:"device" query:"device" form:"device"`
+	Timeout    string `json:"timeout_express,omitempty" query:"timeout_express" form:"timeout_express"` // like Alipay's timeout_express, 1m to 15d
+	Sign       string `json:"sign" query:"sign" form:"sign"`
+	SignType   string `json:"sign_type" query:"sign_type" form:"sign_type"`
 }
 
 // ToURLValues converts the EpaySubmitRequest to url.Values
@@ -46,10 +32,16 @@ func (r *EpaySubmitRequest) ToURLValues() url.Values {
 	values.Add("name", r.Name)
 	values.Add("money", r.Money)
 
-	// Only add param if it's not empty
+	// Only add the optional parameters if they're not empty
 	if r.Param != "" {
 		values.Add("param", r.Param)
 	}
+	if r.Device != "" {
+		values.Add("device", r.Device)
+	}
+	if r.Timeout != "" {
+		values.Add("timeout_express", r.Timeout)
+	}
 
 	values.Add("sign", r.Sign)
 	values.Add("sign_type", r.SignType)
@@ -59,26 +51,20 @@ func (r *EpaySubmitRequest) ToURLValues() url.Values {
 
 // EpayNotifyRequest represents the notification data sent by the payment system
 type EpayNotifyRequest struct {
-	Pid         int    `json:"pid" query:"pid"`                   // 商户ID
-	TradeNo     string `json:"trade_no" query:"trade_no"`         // 易支付订单号
-	OutTradeNo  string `json:"out_trade_no" query:"out_trade_no"` // 商户订单号
-	Type        string `json:"type" query:"type"`                 // 支付方式
-	Name        string `json:"name" query:"name"`                 // 商品名称
-	Money       string `json:"money" query:"money"`               // 商品金额
-	TradeStatus string `json:"trade_status" query:"trade_status"` // 支付状态
-	Param       string `json:"param" query:"param"`               // 业务扩展参数
-	Sign        string `json:"sign" query:"sign"`                 // 签名字符串
-	SignType    string `json:"sign_type" query:"sign_type"`       // 签名类型
-}
-
-// GetSign returns the sign value
-func (r *EpayNotifyRequest) GetSign() string {
-	return r.Sign
-}
-
-// GetSignType returns the sign type
-func (r *EpayNotifyRequest) GetSignType() string {
-	return r.SignType
+	Pid         int    `json:"pid" query:"pid"`                     // 商户ID
+	TradeNo     string `json:"trade_no" query:"trade_no"`           // 易支付订单号
+	OutTradeNo  string `json:"out_trade_no" query:"out_trade_no"`   // 商户订单号
+	Type        string `json:"type" query:"type"`                   // 支付方式
+	Name        string `json:"name" query:"name"`                   // 商品名称
+	Money       string `json:"money" query:"money"`                 // 商品金额
+	TradeStatus string `json:"trade_status" query:"trade_status"`   // 支付状态
+	Param       string `json:"param" query:"param"`                 // 业务扩展参数
+	NotifyType  string `json:"notify_type" query:"notify_type"`     // 通知类型，退款为 refund，关闭为 close，付款为空
+	RefundMoney string `json:"refund_money" query:"refund_money"`   // 累计退款金额
+	OutRefundNo string `json:"out_refund_no" query:"out_refund_no"` // 退款单号
+	RefundTime  string `json:"refund_time" query:"refund_time"`     // 退款时间
+	Sign        string `json:"sign" query:"sign"`                   // 签名字符串
+	SignType    string `json:"sign_type" query:"sign_type"`         // 签名类型
 }
 
 // ToURLValues converts the EpayNotifyRequest to url.Values
@@ -98,8 +84,113 @@ func (r *EpayNotifyRequest) ToURLValues() url.Values {
 		values.Add("param", r.Param)
 	}
 
+	// Refund and close notifications are labeled, payments stay as they were
+	if r.NotifyType != "" {
+		values.Add("notify_type", r.NotifyType)
+		if r.RefundMoney != "" {
+			values.Add("refund_money", r.RefundMoney)
+		}
+		if r.OutRefundNo != "" {
+			values.Add("out_refund_no", r.OutRefundNo)
+		}
+		if r.RefundTime != "" {
+			values.Add("refund_time", r.RefundTime)
+		}
+	}
+
 	values.Add("sign", r.Sign)
 	values.Add("sign_type", r.SignType)
 
 	return values
 }
+
+const (
+	EpayCodeSuccess = 1  // 成功
+	EpayCodeFailure = -1 // 失败
+)
+
+// EpayApiResponse is the common JSON envelope replied by epay APIs
+type EpayApiResponse struct {
+	Code int    `json:"code"` // 返回状态码，1 为成功
+	Msg  string `json:"msg"`  // 返回信息
+}
+
+// EpayMapiResponse is the JSON reply of the API-mode submit (mapi.php)
+type EpayMapiResponse struct {
+	Code      int    `json:"code"`                // 返回状态码，1 为成功
+	Msg       string `json:"msg"`                 // 返回信息
+	TradeNo   string `json:"trade_no,omitempty"`  // 订单号
+	PayUrl    string `json:"payurl,omitempty"`    // 支付跳转url
+	QRCode    string `json:"qrcode,omitempty"`    // 二维码链接
+	UrlScheme string `json:"urlscheme,omitempty"` // 小程序跳转url
+}
+
+// EpayApiRequest represents a merchant call to api.php, authenticated with the merchant key
+type EpayApiRequest struct {
+	Act         string `json:"act" query:"act" form:"act"`                               // 操作类型
+	Pid         int    `json:"pid" query:"pid" form:"pid"`                               // 商户ID
+	Key         string `json:"key" query:"key" form:"key"`                               // 商户密钥
+	TradeNo     string `json:"trade_no" query:"trade_no" form:"trade_no"`                // 易支付订单号
+	OutTradeNo  string `json:"out_trade_no" query:"out_trade_no" form:"out_trade_no"`    // 商户订单号
+	Money       string `json:"money" query:"money" form:"money"`                         // 退款金额
+	OutRefundNo string `json:"out_refund_no" query:"out_refund_no" form:"out_refund_no"` // 商户退款单号
+}
+
+// EpayOrderResponse is the JSON reply of api.php?act=order
+type EpayOrderResponse struct {
+	Code       int    `json:"code"`         // 返回状态码，1 为成功
+	Msg        string `json:"msg"`          // 返回信息
+	TradeNo    string `json:"trade_no"`     // 易支付订单号
+	OutTradeNo string `json:"out_trade_no"` // 商户订单号
+	ApiTradeNo string `json:"api_trade_no"` // 第三方订单号
+	Type       string `json:"type"`         // 支付方式
+	Pid        int    `json:"pid"`          // 商户ID
+	Addtime    string `json:"addtime"`      // 创建订单时间
+	Endtime    string `json:"endtime"`      // 完成交易时间
+	Name       string `json:"name"`         // 商品名称
+	Money      string `json:"money"`        // 商品金额
+	Status     int    `json:"status"`       // 支付状态，1 为支付成功，0 为未支付
+	Param      string `json:"param"`        // 业务扩展参数
+	Buyer      string `json:"buyer"`        // 支付者账号
+}
+
+// EpayRefundResponse is the JSON reply of api.php?act=refund
+type EpayRefundResponse struct {
+	Code        int    `json:"code"`                    // 返回状态码，1 为成功
+	Msg         string `json:"msg"`                     // 返回信息
+	TradeNo     string `json:"trade_no,omitempty"`      // 易支付订单号
+	OutRefundNo string `json:"out_refund_no,omitempty"` // 商户退款单号
+	Money       string `json:"money,omitempty"`         // 本次退款金额
+	RefundFee   string `json:"refund_fee,omitempty"`    // 订单累计退款金额
+}
+
+// EpayNotifyAttempt is one delivery attempt of a notification
+type EpayNotifyAttempt struct {
+	Time      string `json:"time"`               // 发送时间
+	Method    string `json:"method"`             // 请求方式
+	Url       string `json:"url"`                // 请求地址，签名已隐去
+	Status    int    `json:"status"`             // HTTP 状态码，未收到响应为 0
+	Response  string `json:"response,omitempty"` // 响应内容片段
+	Error     string `json:"error,omitempty"`    // 失败原因
+	LatencyMs int64  `json:"latency_ms"`         // 耗时（毫秒）
+}
+
+// EpayNotifyLog is the delivery history of one notification
+type EpayNotifyLog struct {
+	Pid         int                 `json:"pid"`                   // 商户ID
+	TradeNo     string              `json:"trade_no"`              // 易支付订单号
+	OutTradeNo  string              `json:"out_trade_no"`          // 商户订单号
+	TradeStatus string              `json:"trade_status"`          // 通知的支付状态
+	NotifyType  string              `json:"notify_type,omitempty"` // 通知类型
+	State       string              `json:"state"`                 // 投递状态，pending、delivered 或 dead_letter
+	Addtime     string              `json:"addtime"`               // 通知创建时间
+	Nexttime    string              `json:"nexttime,omitempty"`    // 下次重试时间
+	Attempts    []EpayNotifyAttempt `json:"attempts"`              // 投递记录
+}
+
+// EpayNotifyLogResponse is the JSON reply of api.php?act=notify_log
+type EpayNotifyLogResponse struct {
+	Code int             `json:"code"` // 返回状态码，1 为成功
+	Msg  string          `json:"msg"`  // 返回信息
+	Data []EpayNotifyLog `json:"data"` // 通知记录，新的在前
+}
@@ -0,0 +1,190 @@
+package epay
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	EpayV2CodeSuccess = 0 // V2 接口成功状态码
+)
+
+// NewTimestamp returns the current unix timestamp as used by the V2 protocol
+func NewTimestamp() string {
+	return strconv.FormatInt(time.Now().Unix(), 10)
+}
+
+// CheckTimestamp rejects V2 requests whose timestamp is missing or too far from now
+func CheckTimestamp(ts string, tolerance time.Duration) error {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %w", err)
+	}
+
+	diff := time.Since(time.Unix(sec, 0))
+	if diff > tolerance || diff < -tolerance {
+		return fmt.Errorf("timestamp expired")
+	}
+	return nil
+}
+
+// EpayV2CreateRequest represents a call to /api/pay/create
+type EpayV2CreateRequest struct {
+	Pid        int    `json:"pid" form:"pid"`                         // 商户ID
+	Method     string `json:"method" form:"method"`                   // 接口类型
+	Device     string `json:"device" form:"device"`                   // 设备类型
+	Type       string `json:"type" form:"type"`                       // 支付方式
+	OutTradeNo string `json:"out_trade_no" form:"out_trade_no"`       // 商户订单号
+	NotifyUrl  string `json:"notify_url" form:"notify_url"`           // 异步通知地址
+	ReturnUrl  string `json:"return_url" form:"return_url"`           // 跳转通知地址
+	Name       string `json:"name" form:"name"`                       // 商品名称
+	Money      string `json:"money" form:"money"`                     // 商品金额
+	ClientIp   string `json:"clientip" form:"clientip"`               // 用户IP地址
+	Param      string `json:"param" form:"param"`                     // 业务扩展参数
+	Timeout    string `json:"timeout_express" form:"timeout_express"` // 支付超时时间，如 30m、2h、1d
+	Timestamp  string `json:"timestamp" form:"timestamp"`             // 当前时间戳
+	Sign       string `json:"sign" form:"sign"`                       // 签名字符串
+	SignType   string `json:"sign_type" form:"sign_type"`             // 签名类型
+}
+
+// ToSubmitRequest converts the business fields into an EpaySubmitRequest
+func (r *EpayV2CreateRequest) ToSubmitRequest() EpaySubmitRequest {
+	return EpaySubmitRequest{
+		Pid:        r.Pid,
+		Type:       r.Type,
+		OutTradeNo: r.OutTradeNo,
+		NotifyUrl:  r.NotifyUrl,
+		ReturnUrl:  r.ReturnUrl,
+		Name:       r.Name,
+		Money:      r.Money,
+		Param:      r.Param,
+		Device:     r.Device,
+		Timeout:    r.Timeout,
+	}
+}
+
+// EpayV2CreateResponse is the signed JSON reply of /api/pay/create
+type EpayV2CreateResponse struct {
+	Code      int    `json:"code"`      // 返回状态码，0 为成功
+	Msg       string `json:"msg"`       // 返回信息
+	TradeNo   string `json:"trade_no"`  // 平台订单号
+	PayType   string `json:"pay_type"`  // 发起支付类型
+	PayInfo   string `json:"pay_info"`  // 发起支付参数
+	Timestamp string `json:"timestamp"` // 当前时间戳
+	Sign      string `json:"sign"`      // 签名字符串
+	SignType  string `json:"sign_type"` // 签名类型
+}
+
+// EpayV2QueryRequest represents a call to /api/pay/query or /api/pay/refund
+type EpayV2QueryRequest struct {
+	Pid         int    `json:"pid" form:"pid"`                     // 商户ID
+	TradeNo     string `json:"trade_no" form:"trade_no"`           // 平台订单号
+	OutTradeNo  string `json:"out_trade_no" form:"out_trade_no"`   // 商户订单号
+	Money       string `json:"money" form:"money"`                 // 退款金额
+	OutRefundNo string `json:"out_refund_no" form:"out_refund_no"` // 商户退款单号
+	Timestamp   string `json:"timestamp" form:"timestamp"`         // 当前时间戳
+	Sign        string `json:"sign" form:"sign"`                   // 签名字符串
+	SignType    string `json:"sign_type" form:"sign_type"`         // 签名类型
+}
+
+// ToApiRequest converts the business fields into an EpayApiRequest
+func (r *EpayV2QueryRequest) ToApiRequest() EpayApiRequest {
+	return EpayApiRequest{
+		Pid:         r.Pid,
+		TradeNo:     r.TradeNo,
+		OutTradeNo:  r.OutTradeNo,
+		Money:       r.Money,
+		OutRefundNo: r.OutRefundNo,
+	}
+}
+
+// EpayV2QueryResponse is the signed JSON reply of /api/pay/query
+type EpayV2QueryResponse struct {
+	Code       int    `json:"code"`         // 返回状态码，0 为成功
+	Msg        string `json:"msg"`          // 返回信息
+	TradeNo    string `json:"trade_no"`     // 平台订单号
+	OutTradeNo string `json:"out_trade_no"` // 商户订单号
+	ApiTradeNo string `json:"api_trade_no"` // 第三方订单号
+	Type       string `json:"type"`         // 支付方式
+	Status     int    `json:"status"`       // 支付状态，1 为支付成功，0 为未支付
+	Pid        int    `json:"pid"`          // 商户ID
+	Addtime    string `json:"addtime"`      // 创建订单时间
+	Endtime    string `json:"endtime"`      // 完成交易时间
+	Name       string `json:"name"`         // 商品名称
+	Money      string `json:"money"`        // 商品金额
+	Param      string `json:"param"`        // 业务扩展参数
+	Buyer      string `json:"buyer"`        // 支付者账号
+	Timestamp  string `json:"timestamp"`    // 当前时间戳
+	Sign       string `json:"sign"`         // 签名字符串
+	SignType   string `json:"sign_type"`    // 签名类型
+}
+
+// EpayV2RefundResponse is the signed JSON reply of /api/pay/refund
+type EpayV2RefundResponse struct {
+	Code        int    `json:"code"`          // 返回状态码，0 为成功
+	Msg         string `json:"msg"`           // 返回信息
+	TradeNo     string `json:"trade_no"`      // 平台订单号
+	OutRefundNo string `json:"out_refund_no"` // 商户退款单号
+	Money       string `json:"money"`         // 退款金额
+	Timestamp   string `json:"timestamp"`     // 当前时间戳
+	Sign        string `json:"sign"`          // 签名字符串
+	SignType    string `json:"sign_type"`     // 签名类型
+}
+
+// EpayV2NotifyRequest represents the V2 notification sent to merchants
+type EpayV2NotifyRequest struct {
+	Pid         int    `json:"pid"`           // 商户ID
+	TradeNo     string `json:"trade_no"`      // 平台订单号
+	OutTradeNo  string `json:"out_trade_no"`  // 商户订单号
+	ApiTradeNo  string `json:"api_trade_no"`  // 第三方订单号
+	Type        string `json:"type"`          // 支付方式
+	TradeStatus string `json:"trade_status"`  // 支付状态
+	Addtime     string `json:"addtime"`       // 创建订单时间
+	Endtime     string `json:"endtime"`       // 完成交易时间
+	Name        string `json:"name"`          // 商品名称
+	Money       string `json:"money"`         // 商品金额
+	Param       string `json:"param"`         // 业务扩展参数
+	Buyer       string `json:"buyer"`         // 支付者账号
+	NotifyType  string `json:"notify_type"`   // 通知类型，退款为 refund，关闭为 close，付款为空
+	RefundMoney string `json:"refund_money"`  // 累计退款金额
+	OutRefundNo string `json:"out_refund_no"` // 退款单号
+	RefundTime  string `json:"refund_time"`   // 退款时间
+	Timestamp   string `json:"timestamp"`     // 当前时间戳
+	Sign        string `json:"sign"`          // 签名字符串
+	SignType    string `json:"sign_type"`     // 签名类型
+}
+
+// ToURLValues converts the EpayV2NotifyRequest to url.Values, leaving out empty fields
+func (r *EpayV2NotifyRequest) ToURLValues() url.Values {
+	values := url.Values{}
+
+	add := func(k, v string) {
+		if v != "" {
+			values.Add(k, v)
+		}
+	}
+
+	values.Add("pid", fmt.Sprintf("%d", r.Pid))
+	add("trade_no", r.TradeNo)
+	add("out_trade_no", r.OutTradeNo)
+	add("api_trade_no", r.ApiTradeNo)
+	add("type", r.Type)
+	add("trade_status", r.TradeStatus)
+	add("addtime", r.Addtime)
+	add("endtime", r.Endtime)
+	add("name", r.Name)
+	add("money", r.Money)
+	add("param", r.Param)
+	add("buyer", r.Buyer)
+	add("notify_type", r.NotifyType)
+	add("refund_money", r.RefundMoney)
+	add("out_refund_no", r.OutRefundNo)
+	add("refund_time", r.RefundTime)
+	add("timestamp", r.Timestamp)
+	add("sign", r.Sign)
+	add("sign_type", r.SignType)
+
+	return values
+}
@@ -0,0 +1,74 @@
+package epay
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// decodeKey accepts either a PEM block or the bare base64 body that epay
+// merchant consoles usually hand out
+func decodeKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, errors.New("key is empty")
+	}
+
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		return block.Bytes, nil
+	}
+
+	der, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("base64 decoding failed: %w", err)
+	}
+	return der, nil
+}
+
+// ParseRSAPublicKey parses a PKIX or PKCS#1 RSA public key
+func ParseRSAPublicKey(s string) (*rsa.PublicKey, error) {
+	der, err := decodeKey(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("public key is not an RSA key")
+		}
+		return rsaPub, nil
+	}
+
+	pub, err := x509.ParsePKCS1PublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RSA public key: %w", err)
+	}
+	return pub, nil
+}
+
+// ParseRSAPrivateKey parses a PKCS#8 or PKCS#1 RSA private key
+func ParseRSAPrivateKey(s string) (*rsa.PrivateKey, error) {
+	der, err := decodeKey(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if priv, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		rsaPriv, ok := priv.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key is not an RSA key")
+		}
+		return rsaPriv, nil
+	}
+
+	priv, err := x509.ParsePKCS1PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RSA private key: %w", err)
+	}
+	return priv, nil
+}
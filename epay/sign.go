@@ -0,0 +1,146 @@
+package epay
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// SignKey holds the key material a Signer may need. Digest based sign types
+// use the shared Secret, RSA uses the key pair.
+type SignKey struct {
+	Secret     string          // shared merchant key
+	PublicKey  *rsa.PublicKey  // verifies RSA signs made by the peer
+	PrivateKey *rsa.PrivateKey // makes RSA signs for the peer
+}
+
+// Signer implements one sign_type over the sign content built by BuildSignContent
+type Signer interface {
+	Sign(content string, key *SignKey) (string, error)
+	Verify(content string, sign string, key *SignKey) error
+}
+
+var (
+	signersMu sync.RWMutex
+	signers   = map[string]Signer{}
+)
+
+func init() {
+	RegisterSigner("MD5", digestSigner{hash: func(b []byte) []byte { h := md5.Sum(b); return h[:] }})
+	RegisterSigner("SHA256", digestSigner{hash: func(b []byte) []byte { h := sha256.Sum256(b); return h[:] }})
+	RegisterSigner("HMAC-SHA256", hmacSigner{})
+	RegisterSigner("RSA", rsaSigner{})
+	RegisterSigner("RSA-SHA256", rsaSigner{})
+}
+
+// RegisterSigner registers the Signer for a sign_type, replacing any previous one
+func RegisterSigner(signType string, s Signer) {
+	signersMu.Lock()
+	defer signersMu.Unlock()
+	signers[strings.ToUpper(signType)] = s
+}
+
+// LookupSigner returns the Signer for a sign_type. An empty sign_type means
+// MD5, as in the stock epay; unknown sign types are an error.
+func LookupSigner(signType string) (Signer, error) {
+	if signType == "" {
+		signType = "MD5"
+	}
+
+	signersMu.RLock()
+	defer signersMu.RUnlock()
+	s, ok := signers[strings.ToUpper(signType)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sign_type: %s", signType)
+	}
+	return s, nil
+}
+
+// digestSigner signs with hex(hash(content + secret)), the stock epay scheme
+type digestSigner struct {
+	hash func([]byte) []byte
+}
+
+func (s digestSigner) Sign(content string, key *SignKey) (string, error) {
+	if key.Secret == "" {
+		return "", errors.New("merchant key is not set")
+	}
+	return hex.EncodeToString(s.hash([]byte(content + key.Secret))), nil
+}
+
+func (s digestSigner) Verify(content string, sign string, key *SignKey) error {
+	expected, err := s.Sign(content, key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(sign))) {
+		return errors.New("invalid sign")
+	}
+	return nil
+}
+
+// hmacSigner signs with hex(HMAC-SHA256(secret, content))
+type hmacSigner struct{}
+
+func (hmacSigner) Sign(content string, key *SignKey) (string, error) {
+	if key.Secret == "" {
+		return "", errors.New("merchant key is not set")
+	}
+	h := hmac.New(sha256.New, []byte(key.Secret))
+	h.Write([]byte(content))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s hmacSigner) Verify(content string, sign string, key *SignKey) error {
+	expected, err := s.Sign(content, key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(sign))) {
+		return errors.New("invalid sign")
+	}
+	return nil
+}
+
+// rsaSigner signs with base64(SHA256WithRSA(content)), as in the epay V2 protocol
+type rsaSigner struct{}
+
+func (rsaSigner) Sign(content string, key *SignKey) (string, error) {
+	if key.PrivateKey == nil {
+		return "", errors.New("rsa private key is not set")
+	}
+
+	hash := sha256.Sum256([]byte(content))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key.PrivateKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("rsa signing failed: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+func (rsaSigner) Verify(content string, sign string, key *SignKey) error {
+	if key.PublicKey == nil {
+		return errors.New("rsa public key is not set")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(sign)
+	if err != nil {
+		return fmt.Errorf("invalid sign encoding: %w", err)
+	}
+
+	hash := sha256.Sum256([]byte(content))
+	if err := rsa.VerifyPKCS1v15(key.PublicKey, crypto.SHA256, hash[:], sig); err != nil {
+		return errors.New("invalid sign")
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package epay
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// tradeNoRandomDigits is the length of the random suffix of trade numbers.
+// Being fixed, the pid in between can always be told apart.
+const tradeNoRandomDigits = 8
+
+var tradeNoRandomMax = big.NewInt(100_000_000)
+
+// NewTradeNo returns a new platform trade_no for an order of pid: the time,
+// the pid and random digits. It is what Alipay knows the order as, so two
+// merchants using the same out_trade_no never meet at Alipay.
+func NewTradeNo(pid int) (string, error) {
+	n, err := rand.Int(rand.Reader, tradeNoRandomMax)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate trade_no: %w", err)
+	}
+
+	return time.Now().Format("20060102150405") + strconv.Itoa(pid) + fmt.Sprintf("%0*d", tradeNoRandomDigits, n), nil
+}
@@ -1,46 +1,64 @@
 package epay
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/url"
 	"reflect"
 	"sort"
 	"strings"
 )
 
-// CalculateSign calculates the sign for the given request and key
-func CalculateSign(i EpaySignedRequest, key string) (string, error) {
-	// Extract all fields from the request
+// BuildSignContent builds the string to be signed from the received parameters
+// exactly as the PHP reference does: every non-empty parameter except sign and
+// sign_type, sorted by name and joined as k=v&k=v
+func BuildSignContent(values url.Values) string {
+	// Sort the keys
+	var keys []string
+	for k := range values {
+		// Skip sign and sign_type fields, and empty values
+		if k == "sign" || k == "sign_type" || values.Get(k) == "" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// Build the string to sign
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%s", k, values.Get(k)))
+	}
+
+	// Join the parts with &
+	return strings.Join(parts, "&")
+}
+
+// StructValues collects the fields of an outgoing message struct into
+// url.Values by their json tags, so that it can be signed like received
+// parameters. Fields of complex types are skipped.
+func StructValues(i interface{}) (url.Values, error) {
 	val := reflect.ValueOf(i)
 	if val.Kind() == reflect.Ptr {
 		val = val.Elem()
 	}
 
 	if val.Kind() != reflect.Struct {
-		return "", errors.New("request is not a struct")
+		return nil, errors.New("message is not a struct")
 	}
 
-	// Collect all fields as key-value pairs
-	params := make(map[string]string)
+	values := url.Values{}
 	typ := val.Type()
 	for i := 0; i < val.NumField(); i++ {
 		field := typ.Field(i)
 
 		tag := field.Tag.Get("json")
-		if tag == "" {
+		if tag == "" || tag == "-" {
 			continue
 		}
 
 		// Extract the field name from the tag
-		parts := strings.Split(tag, ",")
-		name := parts[0]
-
-		// Skip sign and sign_type fields
-		if name == "sign" || name == "sign_type" {
-			continue
-		}
+		name := strings.Split(tag, ",")[0]
 
 		// Get the field value as string
 		fieldVal := val.Field(i)
@@ -62,74 +80,62 @@ func CalculateSign(i EpaySignedRequest, key string) (string, error) {
 			continue
 		}
 
-		// Skip empty values
-		if strVal == "" {
-			continue
-		}
-
-		params[name] = strVal
+		values.Set(name, strVal)
 	}
 
-	// Sort the keys
-	var keys []string
-	for k := range params {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
+	return values, nil
+}
 
-	// Build the string to sign
-	var parts []string
-	for _, k := range keys {
-		parts = append(parts, fmt.Sprintf("%s=%s", k, params[k]))
+// CalculateSign calculates the sign of the given parameters with the scheme
+// named by their sign_type
+func CalculateSign(values url.Values, key *SignKey) (string, error) {
+	signer, err := LookupSigner(values.Get("sign_type"))
+	if err != nil {
+		return "", err
 	}
 
-	// Join the parts with &
-	str := strings.Join(parts, "&")
-
-	// Append the key
-	str = str + key
+	return signer.Sign(BuildSignContent(values), key)
+}
 
-	// Calculate MD5
-	hash := md5.Sum([]byte(str))
-	sign := hex.EncodeToString(hash[:])
+// SignValues calculates the sign of the given parameters and stores it in them
+func SignValues(values url.Values, key *SignKey) error {
+	sign, err := CalculateSign(values, key)
+	if err != nil {
+		return err
+	}
 
-	// Return lowercase sign
-	return strings.ToLower(sign), nil
+	values.Set("sign", sign)
+	return nil
 }
 
 type EpaySignValidator struct {
-	Key string // Merchant key for signing
+	Key *SignKey // Merchant key material for verifying
 }
 
-// NewEpaySignValidator creates a new validator with the given merchant key
-func NewEpaySignValidator(key string) *EpaySignValidator {
+// NewEpaySignValidator creates a new validator with the given merchant key material
+func NewEpaySignValidator(key *SignKey) *EpaySignValidator {
 	return &EpaySignValidator{
 		Key: key,
 	}
 }
 
-// Validate checks if the sign in the request is valid
-func (v *EpaySignValidator) Validate(i EpaySignedRequest) error {
-	if v.Key == "" {
+// Validate checks if the sign over the received parameters is valid for their
+// sign_type. Unknown sign types are rejected.
+func (v *EpaySignValidator) Validate(values url.Values) error {
+	if v.Key == nil {
 		return errors.New("merchant key is not set")
 	}
 
 	// Get the sign from the request
-	providedSign := i.GetSign()
+	providedSign := values.Get("sign")
 	if providedSign == "" {
 		return errors.New("sign is empty")
 	}
 
-	// Calculate the expected sign
-	expectedSign, err := CalculateSign(i, v.Key)
+	signer, err := LookupSigner(values.Get("sign_type"))
 	if err != nil {
-		return fmt.Errorf("failed to calculate sign: %w", err)
+		return err
 	}
 
-	// Compare the signs
-	if providedSign != expectedSign {
-		return fmt.Errorf("invalid sign: expected %s, got %s", expectedSign, providedSign)
-	}
-
-	return nil
+	return signer.Verify(BuildSignContent(values), providedSign, v.Key)
 }
@@ -30,16 +30,15 @@ func main() {
 	epayKey := sec.DeriveMyEpayKey(param.Pid, viper.GetString("epay.fwd_secret"))
 	fmt.Println(epayKey)
 
-	var err error
-	param.Sign, err = epay.CalculateSign(&param, epayKey)
-	if err != nil {
+	values := param.ToURLValues()
+	if err := epay.SignValues(values, &epay.SignKey{Secret: epayKey}); err != nil {
 		panic(err)
 	}
 
-	fmt.Println(param.Sign)
+	fmt.Println(values.Get("sign"))
 
 	// Send the GET request
-	resp, err := http.Post("http://127.0.0.1:1323/epay/test/submit.php", "application/x-www-form-urlencoded", strings.NewReader(param.ToURLValues().Encode()))
+	resp, err := http.Post("http://127.0.0.1:1323/epay/test/submit.php", "application/x-www-form-urlencoded", strings.NewReader(values.Encode()))
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/api"
+	"github.com/yiffyi/epay-fwd/misc"
+)
+
+// runResend implements the resend subcommand. The dispatcher lives in the
+// running server, so it asks the server through the admin endpoint.
+func runResend(args []string) {
+	flags := flag.NewFlagSet("resend", flag.ExitOnError)
+	server := flags.String("server", "", "base URL of the running server (default derived from listen_addr)")
+	token := flags.String("token", "", "admin token (default admin.token)")
+
+	var req api.AdminResendRequest
+	flags.StringVar(&req.Env, "env", "", "environment of the order (default the one it was created in)")
+	flags.IntVar(&req.Pid, "pid", 0, "merchant of -out-trade-no")
+	flags.StringVar(&req.TradeNo, "trade-no", "", "trade_no of the order")
+	flags.StringVar(&req.OutTradeNo, "out-trade-no", "", "merchant out_trade_no of the order, with -pid")
+	flags.StringVar(&req.From, "from", "", "resend undelivered notifications created at or after this RFC 3339 time")
+	flags.StringVar(&req.To, "to", "", "resend undelivered notifications created before this RFC 3339 time")
+	flags.BoolVar(&req.DryRun, "dry-run", false, "print the signed notify URLs without sending them")
+	flags.BoolVar(&req.Release, "release", false, "also resend quarantined orders, marking them paid")
+	flags.Parse(args)
+
+	misc.SetupConfig()
+
+	if *server == "" {
+		*server = localServerURL(viper.GetString("listen_addr"))
+	}
+	if *token == "" {
+		*token = viper.GetString("admin.token")
+	}
+
+	resp, err := postResend(strings.TrimRight(*server, "/")+"/admin/notify/resend", *token, &req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, r := range resp.Results {
+		switch {
+		case r.Error != "":
+			failed = true
+			fmt.Printf("%s\t%s\terror: %s\n", r.TradeNo, r.OutTradeNo, r.Error)
+		case resp.DryRun:
+			fmt.Printf("%s\t%s\t%s\n", r.TradeNo, r.OutTradeNo, r.URL)
+		default:
+			fmt.Printf("%s\t%s\tqueued as %s\n", r.TradeNo, r.OutTradeNo, r.JobID)
+		}
+	}
+	if len(resp.Results) == 0 {
+		fmt.Println("Nothing to resend")
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// localServerURL turns the listen address into a URL reaching it locally
+func localServerURL(listenAddr string) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "http://" + listenAddr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+func postResend(endpoint, token string, req *api.AdminResendRequest) (*api.AdminResendResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	data, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server replied %s: %s", httpResp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var resp api.AdminResendResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &resp, nil
+}
@@ -2,20 +2,41 @@ package main
 
 import (
 	"net/http"
+	"os"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/alert"
 	"github.com/yiffyi/epay-fwd/api"
 	"github.com/yiffyi/epay-fwd/misc"
+	"github.com/yiffyi/epay-fwd/notify"
+	"github.com/yiffyi/epay-fwd/store"
+	"github.com/yiffyi/epay-fwd/web"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "resend" {
+		runResend(os.Args[2:])
+		return
+	}
+
 	misc.SetupConfig()
 	misc.SetupLogger()
 
+	if err := store.Setup(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to open order store")
+	}
+
+	alert.SetupSinks()
+	if err := notify.SetupDispatcher(store.Orders(), api.SignNotifyJob); err != nil {
+		log.Fatal().Err(err).Msg("Failed to set up notify dispatcher")
+	}
+	api.SetupOrderSweeper()
+
 	e := echo.New()
+	e.Renderer = web.NewRenderer()
 	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
 		LogURI:       true,
 		LogStatus:    true,
@@ -48,8 +69,14 @@ func main() {
 	gEpay := e.Group("/epay")
 	api.SetupEpayEndpoints(gEpay)
 
+	gRoot := e.Group("")
+	api.SetupEpayRootEndpoints(gRoot)
+
 	gAlipay := e.Group("/alipay")
 	api.SetupAlipayEndpoints(gAlipay)
 
+	gAdmin := e.Group("/admin")
+	api.SetupAdminEndpoints(gAdmin)
+
 	e.Logger.Fatal(e.Start(viper.GetString("listen_addr")))
 }
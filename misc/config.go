@@ -22,8 +22,48 @@ func SetupConfig() {
 	viper.SetDefault("alipay.server_public_key", "")
 	viper.SetDefault("alipay.enable_production", false)
 	viper.SetDefault("alipay.encrypt_key", "")
+	viper.SetDefault("alipay.seller_id", "")
+	viper.SetDefault("alipay.check_receipt_amount", false)
 
 	viper.SetDefault("epay.fwd_secret", "")
+	viper.SetDefault("epay.default_env", "sandbox")
+	viper.SetDefault("epay.types", []string{"alipay"})
+	viper.SetDefault("epay.v2.platform_private_key", "")
+	viper.SetDefault("epay.v2.timestamp_tolerance", "5m")
+
+	viper.SetDefault("store.path", "epay-fwd.db")
+
+	viper.SetDefault("order.timeout", "0s") // 0 leaves it to Alipay
+	viper.SetDefault("order.sweep_interval", "1m")
+	viper.SetDefault("order.notify_close", false)
+
+	viper.SetDefault("notify.workers", 8)
+	viper.SetDefault("notify.max_per_host", 4)
+	viper.SetDefault("notify.breaker.failures", 5)
+	viper.SetDefault("notify.breaker.cooldown", "1m")
+	viper.SetDefault("notify.breaker.max_cooldown", "30m")
+	viper.SetDefault("notify.retry_schedule", []string{"0s", "15s", "15s", "30s", "3m", "10m", "20m", "30m", "30m", "30m", "60m", "3h", "3h", "3h", "6h", "6h"})
+
+	viper.SetDefault("outbound.connect_timeout", "5s")
+	viper.SetDefault("outbound.read_timeout", "15s")
+	viper.SetDefault("outbound.timeout", "30s")
+	viper.SetDefault("outbound.proxy", "")
+	viper.SetDefault("outbound.max_redirects", 0)
+	viper.SetDefault("outbound.tls.insecure_skip_verify", false)
+	viper.SetDefault("outbound.tls.ca_file", "")
+	viper.SetDefault("outbound.tls.min_version", "1.2")
+
+	viper.SetDefault("alert.webhook_url", "")
+	viper.SetDefault("alert.smtp.addr", "")
+	viper.SetDefault("alert.smtp.from", "")
+	viper.SetDefault("alert.smtp.to", []string{})
+	viper.SetDefault("alert.smtp.username", "")
+	viper.SetDefault("alert.smtp.password", "")
+	viper.SetDefault("alert.failure_rate.window", "15m")
+	viper.SetDefault("alert.failure_rate.min_attempts", 10)
+	viper.SetDefault("alert.failure_rate.threshold", 0.5)
+
+	viper.SetDefault("admin.token", "")
 
 	viper.SetDefault("log.console", true)
 	viper.SetDefault("log.path", "ocrbench.log")
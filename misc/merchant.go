@@ -0,0 +1,9 @@
+package misc
+
+import "fmt"
+
+// MerchantConfigKey returns the viper key of a per-merchant setting, e.g.
+// merchants.1001.public_key for [merchants.1001] public_key = "..."
+func MerchantConfigKey(pid int, name string) string {
+	return fmt.Sprintf("merchants.%d.%s", pid, name)
+}
@@ -0,0 +1,363 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/yiffyi/epay-fwd/outbound"
+)
+
+// Dispatcher delivers notify jobs from a pool of workers, retrying failed
+// deliveries on the retry schedule. Every job is persisted before it is
+// accepted and after every attempt.
+type Dispatcher struct {
+	store    Store
+	client   *http.Client
+	schedule []time.Duration // delay before each attempt; its length is the retry budget
+	workers  int
+	queue    chan *Job
+
+	// Hosts limits deliveries per merchant host, nothing is limited if nil
+	Hosts *HostLimiter
+	// Merchant returns how a merchant wants its notifications delivered
+	Merchant func(pid int) MerchantOptions
+	// Sign returns the parameters of a job signed for an attempt about to be
+	// made, so that timestamped notifications are fresh on every retry. The
+	// parameters are delivered as stored if nil.
+	Sign func(job *Job) (url.Values, error)
+	// OnAttempt is called after every attempt once the job's next state is
+	// decided, from the worker that made it
+	OnAttempt func(job *Job, attempt Attempt)
+}
+
+type DeliveryMode string
+
+const (
+	DeliveryGet  DeliveryMode = "get"  // signed parameters in the query string
+	DeliveryForm DeliveryMode = "form" // POST application/x-www-form-urlencoded
+	DeliveryJSON DeliveryMode = "json" // POST application/json, every parameter a string
+)
+
+// MerchantOptions are the per-merchant delivery settings
+type MerchantOptions struct {
+	Ack     string         // body acknowledging a notification, "success" per the epay spec if empty
+	Allowed []netip.Prefix // internal addresses the notify_url may reach; everything else has to be public
+	Mode    DeliveryMode   // DeliveryGet if empty
+}
+
+const (
+	defaultAck     = "success"
+	maxBodyRead    = 4096     // enough to tell an acknowledgement from an error page
+	maxBodyDrain   = 64 << 10 // drained so the connection can be reused; longer bodies close it
+	maxBodySnippet = 256
+)
+
+func NewDispatcher(store Store, client *http.Client, schedule []time.Duration, workers int) *Dispatcher {
+	if len(schedule) == 0 {
+		schedule = []time.Duration{0}
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &Dispatcher{
+		store:    store,
+		client:   client,
+		schedule: schedule,
+		workers:  workers,
+		queue:    make(chan *Job, workers*4),
+	}
+}
+
+// Start resumes the jobs left pending by a previous run and starts the workers
+func (d *Dispatcher) Start() error {
+	pending, err := d.store.Pending()
+	if err != nil {
+		return fmt.Errorf("failed to load pending jobs: %w", err)
+	}
+
+	for i := 0; i < d.workers; i++ {
+		go d.work()
+	}
+
+	for _, job := range pending {
+		d.scheduleJob(job)
+	}
+
+	log.Info().Int("workers", d.workers).Int("pending", len(pending)).Msg("Notify dispatcher started")
+	return nil
+}
+
+// Enqueue persists a new job and schedules its first attempt. It fails with
+// ErrJobExists if a job with the same ID was enqueued before.
+func (d *Dispatcher) Enqueue(job *Job) error {
+	now := time.Now()
+	if job.ID == "" {
+		job.ID = newJobID()
+	}
+	job.State = JobPending
+	job.NextAt = now.Add(d.schedule[0])
+	job.CreatedAt = now
+	job.UpdatedAt = now
+
+	if err := d.store.Create(job); err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("job_id", job.ID).
+		Int("pid", job.Pid).
+		Str("out_trade_no", job.OutTradeNo).
+		Msg("Enqueued merchant notification")
+
+	d.scheduleJob(job)
+	return nil
+}
+
+// Get returns a stored job
+func (d *Dispatcher) Get(id string) (*Job, error) {
+	return d.store.Get(id)
+}
+
+// Undelivered returns the trade status changes with jobs created in [from, to)
+// that have not reached their merchant, as the latest job of each. Changes
+// another job has delivered are left out.
+func (d *Dispatcher) Undelivered(from, to time.Time) ([]*Job, error) {
+	jobs, err := d.store.Query(JobFilter{
+		States:      []JobState{JobPending, JobDeadLetter},
+		CreatedFrom: from,
+		CreatedTo:   to,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A refund is told apart from others of the same trade by its refund number
+	key := func(job *Job) string {
+		return job.TradeNo + "|" + job.TradeStatus + "|" + job.Params.Get("out_refund_no")
+	}
+
+	// Jobs come newest first, so the first of each change is its latest
+	seen := make(map[string]bool)
+	checked := make(map[string]bool)
+	var undelivered []*Job
+	for _, job := range jobs {
+		if job.TradeNo != "" && !checked[job.TradeNo] {
+			checked[job.TradeNo] = true
+
+			delivered, err := d.store.Query(JobFilter{TradeNo: job.TradeNo, States: []JobState{JobDelivered}})
+			if err != nil {
+				return nil, err
+			}
+			for _, done := range delivered {
+				seen[key(done)] = true
+			}
+		}
+
+		if k := key(job); !seen[k] {
+			seen[k] = true
+			undelivered = append(undelivered, job)
+		}
+	}
+	return undelivered, nil
+}
+
+// History returns the jobs matching the filter with their attempts, newest first
+func (d *Dispatcher) History(filter JobFilter) ([]*Job, error) {
+	return d.store.Query(filter)
+}
+
+func (d *Dispatcher) scheduleJob(job *Job) {
+	time.AfterFunc(time.Until(job.NextAt), func() {
+		d.queue <- job
+	})
+}
+
+func (d *Dispatcher) work() {
+	for job := range d.queue {
+		d.deliver(job)
+	}
+}
+
+// deliver makes one attempt and decides what happens to the job next
+func (d *Dispatcher) deliver(job *Job) {
+	// Waiting for a busy or broken host does not use up an attempt
+	host := jobHost(job)
+	if wait, ok := d.Hosts.Acquire(host, time.Now()); !ok {
+		job.NextAt = time.Now().Add(wait)
+		log.Debug().
+			Str("job_id", job.ID).
+			Str("host", host).
+			Time("next_at", job.NextAt).
+			Msg("Deferred merchant notification")
+		d.scheduleJob(job)
+		return
+	}
+
+	attempt := d.send(job)
+	d.Hosts.Release(host, attempt.Error, time.Now())
+	job.Attempts = append(job.Attempts, attempt)
+	job.UpdatedAt = time.Now()
+
+	evt := log.Info()
+	switch {
+	case attempt.Error == "":
+		job.State = JobDelivered
+	case len(job.Attempts) >= len(d.schedule):
+		job.State = JobDeadLetter
+		evt = log.Error()
+	default:
+		job.NextAt = time.Now().Add(d.schedule[len(job.Attempts)])
+		evt = log.Warn()
+	}
+
+	evt.Str("job_id", job.ID).
+		Int("pid", job.Pid).
+		Str("out_trade_no", job.OutTradeNo).
+		Int("attempt", len(job.Attempts)).
+		Int("status_code", attempt.Status).
+		Str("error", attempt.Error).
+		Str("state", string(job.State)).
+		Time("next_at", job.NextAt).
+		Msg("Merchant notification attempt")
+
+	if err := d.store.Save(job); err != nil {
+		log.Error().Err(err).Str("job_id", job.ID).Msg("Failed to save notify job")
+	}
+
+	if d.OnAttempt != nil {
+		d.OnAttempt(job, attempt)
+	}
+
+	if job.State == JobPending {
+		d.scheduleJob(job)
+	}
+}
+
+func (d *Dispatcher) merchant(pid int) MerchantOptions {
+	var opts MerchantOptions
+	if d.Merchant != nil {
+		opts = d.Merchant(pid)
+	}
+	if opts.Ack == "" {
+		opts.Ack = defaultAck
+	}
+	if opts.Mode == "" {
+		opts.Mode = DeliveryGet
+	}
+	return opts
+}
+
+// newRequest builds the delivery request of a job carrying signed parameters.
+// They are the same in every mode, only their encoding differs.
+func newRequest(ctx context.Context, job *Job, mode DeliveryMode) (*http.Request, error) {
+	switch mode {
+	case DeliveryGet:
+		notifyURL, err := job.URL()
+		if err != nil {
+			return nil, err
+		}
+		return http.NewRequestWithContext(ctx, http.MethodGet, notifyURL, nil)
+
+	case DeliveryForm:
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.NotifyUrl, strings.NewReader(job.Params.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+
+	case DeliveryJSON:
+		params := make(map[string]string, len(job.Params))
+		for k := range job.Params {
+			params[k] = job.Params.Get(k)
+		}
+		body, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.NotifyUrl, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported delivery mode %q", mode)
+	}
+}
+
+// send signs the notification and delivers it to the merchant in the
+// merchant's delivery mode. It only counts as delivered when the merchant answers with
+// the acknowledgement body; a 200 error page does not.
+func (d *Dispatcher) send(job *Job) (attempt Attempt) {
+	attempt.At = time.Now()
+	defer func() {
+		attempt.LatencyMs = time.Since(attempt.At).Milliseconds()
+	}()
+
+	opts := d.merchant(job.Pid)
+	ctx := outbound.WithAllowed(context.Background(), opts.Allowed)
+
+	signed := *job
+	if d.Sign != nil {
+		params, err := d.Sign(job)
+		if err != nil {
+			attempt.Error = fmt.Sprintf("failed to sign notification: %v", err)
+			return attempt
+		}
+		signed.Params = params
+	}
+
+	req, err := newRequest(ctx, &signed, opts.Mode)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	attempt.Method = req.Method
+	attempt.URL = job.NotifyUrl
+	if opts.Mode == DeliveryGet {
+		attempt.URL = signed.RedactedURL()
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyRead))
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxBodyDrain))
+
+	attempt.Status = resp.StatusCode
+	attempt.Body = snippet(body)
+
+	switch {
+	case err != nil:
+		attempt.Error = fmt.Sprintf("failed to read response: %v", err)
+	case strings.TrimSpace(string(body)) != opts.Ack:
+		attempt.Error = "merchant did not acknowledge the notification"
+	}
+	return attempt
+}
+
+// snippet shortens a response body for the attempt record, keeping UTF-8 intact
+func snippet(body []byte) string {
+	if len(body) > maxBodySnippet {
+		body = body[:maxBodySnippet]
+	}
+	return strings.ToValidUTF8(string(body), "")
+}
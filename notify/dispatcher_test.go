@@ -0,0 +1,425 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memStore keeps jobs in memory, copied in and out like a real store would
+type memStore struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+func newMemStore() *memStore {
+	return &memStore{jobs: make(map[string]Job)}
+}
+
+func (s *memStore) Create(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[job.ID]; ok {
+		return ErrJobExists
+	}
+	s.jobs[job.ID] = copyJob(job)
+	return nil
+}
+
+func (s *memStore) Save(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = copyJob(job)
+	return nil
+}
+
+func (s *memStore) Get(id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	job = copyJob(&job)
+	return &job, nil
+}
+
+func (s *memStore) Pending() ([]*Job, error) {
+	return s.Query(JobFilter{States: []JobState{JobPending}})
+}
+
+func (s *memStore) Query(filter JobFilter) ([]*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []*Job
+	for _, job := range s.jobs {
+		if len(filter.States) > 0 && !slices.Contains(filter.States, job.State) {
+			continue
+		}
+		job = copyJob(&job)
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+func copyJob(job *Job) Job {
+	c := *job
+	c.Attempts = slices.Clone(job.Attempts)
+	c.Params = make(url.Values, len(job.Params))
+	for k, v := range job.Params {
+		c.Params[k] = slices.Clone(v)
+	}
+	return c
+}
+
+// newTestServer answers notifications with the bodies given, one per request,
+// then with the last one
+func newTestServer(t *testing.T, bodies ...string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var n atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(n.Add(1)) - 1
+		w.Write([]byte(bodies[min(i, len(bodies)-1)]))
+	}))
+	t.Cleanup(server.Close)
+	return server, &n
+}
+
+func newTestDispatcherJob(notifyURL string) *Job {
+	return &Job{
+		ID:          TransitionID("2024010200001", "TRADE_SUCCESS"),
+		Pid:         1001,
+		TradeNo:     "2024010200001",
+		OutTradeNo:  "O1",
+		TradeStatus: "TRADE_SUCCESS",
+		NotifyUrl:   notifyURL,
+		Params:      url.Values{"out_trade_no": {"O1"}, "trade_status": {"TRADE_SUCCESS"}},
+	}
+}
+
+func TestDeliverRetrySchedule(t *testing.T) {
+	server, requests := newTestServer(t, "error")
+	s := newMemStore()
+	schedule := []time.Duration{0, time.Hour, 3 * time.Hour}
+	d := NewDispatcher(s, http.DefaultClient, schedule, 1)
+
+	job := newTestDispatcherJob(server.URL)
+	job.State = JobPending
+	if err := s.Create(job); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	for i := 1; i < len(schedule); i++ {
+		before := time.Now()
+		d.deliver(job)
+
+		stored, _ := s.Get(job.ID)
+		if stored.State != JobPending || len(stored.Attempts) != i {
+			t.Fatalf("after attempt %d the job is %s with %d attempts", i, stored.State, len(stored.Attempts))
+		}
+		// The next attempt waits for the delay of its place in the schedule
+		if stored.NextAt.Before(before.Add(schedule[i])) || stored.NextAt.After(time.Now().Add(schedule[i])) {
+			t.Errorf("after attempt %d the next is at %v, want %v later", i, stored.NextAt, schedule[i])
+		}
+	}
+
+	// The last attempt of the schedule dead-letters the job
+	d.deliver(job)
+	stored, _ := s.Get(job.ID)
+	if stored.State != JobDeadLetter || len(stored.Attempts) != len(schedule) {
+		t.Errorf("after the last attempt the job is %s with %d attempts", stored.State, len(stored.Attempts))
+	}
+	if n := requests.Load(); n != int32(len(schedule)) {
+		t.Errorf("merchant got %d requests, want %d", n, len(schedule))
+	}
+}
+
+func TestDeliverDeferredByHost(t *testing.T) {
+	server, requests := newTestServer(t, "success")
+	d := NewDispatcher(newMemStore(), http.DefaultClient, []time.Duration{0, time.Hour}, 1)
+	d.Hosts = NewHostLimiter(1, 0, 0, 0)
+
+	host := jobHost(newTestDispatcherJob(server.URL))
+	d.Hosts.Acquire(host, time.Now())
+
+	// Waiting for a host at its cap does not use up an attempt
+	job := newTestDispatcherJob(server.URL)
+	before := time.Now()
+	d.deliver(job)
+	if len(job.Attempts) != 0 || requests.Load() != 0 {
+		t.Fatalf("deferred delivery made %d attempts", len(job.Attempts))
+	}
+	if job.NextAt.Before(before.Add(busyRetryDelay)) {
+		t.Errorf("deferred to %v, want %v later", job.NextAt, busyRetryDelay)
+	}
+}
+
+func TestDispatcherRetriesUntilDelivered(t *testing.T) {
+	server, _ := newTestServer(t, "error", "fail", "success")
+	s := newMemStore()
+	schedule := []time.Duration{0, 20 * time.Millisecond, 40 * time.Millisecond, time.Hour}
+	d := NewDispatcher(s, http.DefaultClient, schedule, 2)
+
+	// Every attempt is signed afresh
+	var signs atomic.Int32
+	d.Sign = func(job *Job) (url.Values, error) {
+		params := copyJob(job).Params
+		params.Set("timestamp", strconv.Itoa(int(signs.Add(1))))
+		return params, nil
+	}
+
+	attempts := make(chan Attempt, len(schedule))
+	d.OnAttempt = func(job *Job, attempt Attempt) {
+		attempts <- attempt
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	job := newTestDispatcherJob(server.URL)
+	if err := d.Enqueue(job); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	var got []Attempt
+	for len(got) < 3 {
+		select {
+		case attempt := <-attempts:
+			got = append(got, attempt)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d attempts were made", len(got))
+		}
+	}
+
+	for i, attempt := range got {
+		wantErr := i < 2
+		if (attempt.Error != "") != wantErr || attempt.Status != http.StatusOK || attempt.Method != http.MethodGet {
+			t.Errorf("attempt %d = %+v", i+1, attempt)
+		}
+		if u, _ := url.Parse(attempt.URL); u.Query().Get("timestamp") != strconv.Itoa(i+1) {
+			t.Errorf("attempt %d was made to %s, want it signed for the attempt", i+1, attempt.URL)
+		}
+		if i > 0 && attempt.At.Sub(got[i-1].At) < schedule[i] {
+			t.Errorf("attempt %d came %v after the previous one, want at least %v", i+1, attempt.At.Sub(got[i-1].At), schedule[i])
+		}
+	}
+
+	stored, err := d.Get(job.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if stored.State != JobDelivered || len(stored.Attempts) != 3 {
+		t.Errorf("stored job is %s with %d attempts", stored.State, len(stored.Attempts))
+	}
+	// The stored parameters stay unsigned
+	if stored.Params.Has("timestamp") {
+		t.Errorf("stored params = %v", stored.Params)
+	}
+}
+
+func TestDispatcherResumesPending(t *testing.T) {
+	server, _ := newTestServer(t, "success")
+	s := newMemStore()
+
+	job := newTestDispatcherJob(server.URL)
+	job.State = JobPending
+	job.NextAt = time.Now().Add(-time.Minute)
+	job.Attempts = []Attempt{{At: time.Now().Add(-2 * time.Minute), Error: "timeout"}}
+	delivered := newTestDispatcherJob(server.URL)
+	delivered.ID = "delivered"
+	delivered.State = JobDelivered
+	for _, j := range []*Job{job, delivered} {
+		if err := s.Create(j); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+	}
+
+	d := NewDispatcher(s, http.DefaultClient, []time.Duration{0, time.Hour}, 1)
+	attempts := make(chan *Job, 2)
+	d.OnAttempt = func(job *Job, attempt Attempt) {
+		attempts <- job
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	select {
+	case resumed := <-attempts:
+		if resumed.ID != job.ID || resumed.State != JobDelivered || len(resumed.Attempts) != 2 {
+			t.Errorf("resumed job %s is %s with %d attempts", resumed.ID, resumed.State, len(resumed.Attempts))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending job was not resumed")
+	}
+
+	select {
+	case other := <-attempts:
+		t.Errorf("job %s was delivered again", other.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSendDeliveryModes(t *testing.T) {
+	type request struct {
+		method      string
+		contentType string
+		params      url.Values
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{method: r.Method, contentType: r.Header.Get("Content-Type"), params: r.URL.Query()}
+		switch req.contentType {
+		case "application/x-www-form-urlencoded":
+			r.ParseForm()
+			req.params = r.PostForm
+		case "application/json":
+			var params map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+				t.Errorf("invalid JSON body: %v", err)
+			}
+			req.params = url.Values{}
+			for k, v := range params {
+				req.params.Set(k, v)
+			}
+		}
+		requests <- req
+		w.Write([]byte("success"))
+	}))
+	defer server.Close()
+
+	signed := url.Values{
+		"out_trade_no": {"O1"},
+		"name":         {"VIP 会员 & more"},
+		"param":        {"a=1&b=2"},
+		"trade_status": {"TRADE_SUCCESS"},
+		"sign":         {"0123456789abcdef"},
+		"sign_type":    {"MD5"},
+	}
+
+	tests := []struct {
+		mode            DeliveryMode
+		wantMethod      string
+		wantContentType string
+	}{
+		{"", http.MethodGet, ""},
+		{DeliveryGet, http.MethodGet, ""},
+		{DeliveryForm, http.MethodPost, "application/x-www-form-urlencoded"},
+		{DeliveryJSON, http.MethodPost, "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			d := NewDispatcher(newMemStore(), http.DefaultClient, nil, 1)
+			d.Merchant = func(pid int) MerchantOptions {
+				return MerchantOptions{Mode: tt.mode}
+			}
+			d.Sign = func(job *Job) (url.Values, error) {
+				return signed, nil
+			}
+
+			attempt := d.send(newTestDispatcherJob(server.URL + "/notify.php?ignored=1"))
+			if attempt.Error != "" {
+				t.Fatalf("send() error = %s", attempt.Error)
+			}
+			if attempt.Method != tt.wantMethod {
+				t.Errorf("attempt method = %s, want %s", attempt.Method, tt.wantMethod)
+			}
+
+			// The merchant gets the same signed parameters in every mode
+			req := <-requests
+			if req.method != tt.wantMethod || req.contentType != tt.wantContentType {
+				t.Errorf("merchant got %s %q", req.method, req.contentType)
+			}
+			if req.params.Encode() != signed.Encode() {
+				t.Errorf("merchant got %v, want %v", req.params, signed)
+			}
+
+			// Only a URL carrying the sign has it redacted
+			if strings.Contains(attempt.URL, "0123456789abcdef") {
+				t.Errorf("attempt URL %s shows the sign", attempt.URL)
+			}
+			if tt.wantMethod == http.MethodPost && attempt.URL != server.URL+"/notify.php?ignored=1" {
+				t.Errorf("attempt URL = %s", attempt.URL)
+			}
+		})
+	}
+
+	d := NewDispatcher(newMemStore(), http.DefaultClient, nil, 1)
+	d.Merchant = func(pid int) MerchantOptions {
+		return MerchantOptions{Mode: "xml"}
+	}
+	if attempt := d.send(newTestDispatcherJob(server.URL)); !strings.Contains(attempt.Error, "unsupported delivery mode") {
+		t.Errorf("send() in an unknown mode error = %q", attempt.Error)
+	}
+}
+
+func TestSendAck(t *testing.T) {
+	tests := []struct {
+		name    string
+		ack     string
+		status  int
+		body    string
+		wantErr bool
+	}{
+		{"default", "", http.StatusOK, "success", false},
+		{"surrounded by whitespace", "", http.StatusOK, " success\r\n", false},
+		{"other case", "", http.StatusOK, "SUCCESS", true},
+		{"error page", "", http.StatusOK, "<html><body>error: success expected</body></html>", true},
+		{"ack after the read limit", "", http.StatusOK, strings.Repeat(" ", maxBodyRead) + "success", true},
+		{"empty", "", http.StatusOK, "", true},
+		{"custom", "OK", http.StatusOK, "OK\n", false},
+		{"default with custom", "OK", http.StatusOK, "success", true},
+		{"server error", "", http.StatusInternalServerError, "error", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			d := NewDispatcher(newMemStore(), http.DefaultClient, nil, 1)
+			d.Merchant = func(pid int) MerchantOptions {
+				return MerchantOptions{Ack: tt.ack}
+			}
+
+			attempt := d.send(newTestDispatcherJob(server.URL))
+			if (attempt.Error != "") != tt.wantErr {
+				t.Errorf("send() error = %q, want an error %v", attempt.Error, tt.wantErr)
+			}
+			if attempt.Status != tt.status || len(attempt.Body) > maxBodySnippet {
+				t.Errorf("attempt = %+v", attempt)
+			}
+		})
+	}
+}
+
+// A merchant answering with an endless body does not hold up the worker
+func TestSendEndlessBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := []byte(strings.Repeat("x", 1024))
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	d := NewDispatcher(newMemStore(), &http.Client{Timeout: 5 * time.Second}, nil, 1)
+	attempt := d.send(newTestDispatcherJob(server.URL))
+	if attempt.Error != "merchant did not acknowledge the notification" {
+		t.Errorf("send() error = %q", attempt.Error)
+	}
+}
@@ -0,0 +1,203 @@
+package notify
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"    // delivering normally
+	BreakerOpen     BreakerState = "open"      // failing, deliveries wait for the cooldown
+	BreakerHalfOpen BreakerState = "half_open" // one probe decides whether to close again
+)
+
+const (
+	busyRetryDelay  = time.Second     // a host is at its concurrency cap
+	probeRetryDelay = 5 * time.Second // another delivery is probing a host
+)
+
+// HostStatus is the delivery state of a merchant host
+type HostStatus struct {
+	Host      string       `json:"host"`
+	State     BreakerState `json:"state"`
+	InFlight  int          `json:"in_flight"`
+	Failures  int          `json:"consecutive_failures"`
+	OpenUntil *time.Time   `json:"open_until,omitempty"`
+	LastError string       `json:"last_error,omitempty"`
+}
+
+type hostState struct {
+	state     BreakerState
+	inFlight  int
+	failures  int
+	openUntil time.Time
+	cooldown  time.Duration
+	probing   bool
+	lastError string
+}
+
+// HostLimiter caps concurrent deliveries per destination host and breaks the
+// circuit to hosts that keep failing, so that one broken merchant cannot tie
+// up the workers. A nil HostLimiter lets everything through.
+type HostLimiter struct {
+	MaxInFlight      int           // concurrent deliveries per host, unlimited if 0
+	FailureThreshold int           // consecutive failures that open the circuit, never if 0
+	Cooldown         time.Duration // first pause of an open circuit
+	MaxCooldown      time.Duration // the pause doubles with every failed probe up to this
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+func NewHostLimiter(maxInFlight, failureThreshold int, cooldown, maxCooldown time.Duration) *HostLimiter {
+	return &HostLimiter{
+		MaxInFlight:      maxInFlight,
+		FailureThreshold: failureThreshold,
+		Cooldown:         cooldown,
+		MaxCooldown:      maxCooldown,
+		hosts:            make(map[string]*hostState),
+	}
+}
+
+// jobHost is the host a job is delivered to
+func jobHost(job *Job) string {
+	u, err := url.Parse(job.NotifyUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// Acquire reserves a delivery to host. When the host cannot take one now, it
+// returns false and how long to wait before trying again.
+func (l *HostLimiter) Acquire(host string, now time.Time) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostState{state: BreakerClosed}
+		l.hosts[host] = h
+	}
+
+	if h.state == BreakerOpen {
+		if now.Before(h.openUntil) {
+			return h.openUntil.Sub(now), false
+		}
+		h.state = BreakerHalfOpen
+		h.probing = false
+	}
+
+	if h.state == BreakerHalfOpen {
+		if h.probing {
+			return probeRetryDelay, false
+		}
+		h.probing = true
+	}
+
+	if l.MaxInFlight > 0 && h.inFlight >= l.MaxInFlight {
+		if h.state == BreakerHalfOpen {
+			h.probing = false
+		}
+		return busyRetryDelay, false
+	}
+
+	h.inFlight++
+	return 0, true
+}
+
+// Release ends a delivery acquired with Acquire, failed unless errMsg is empty
+func (l *HostLimiter) Release(host string, errMsg string, now time.Time) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.hosts[host]
+	if !ok {
+		return
+	}
+	h.inFlight--
+
+	if errMsg == "" {
+		if h.state != BreakerClosed {
+			log.Info().Str("host", host).Msg("Closed circuit to merchant host")
+		}
+		h.state = BreakerClosed
+		h.failures = 0
+		h.cooldown = 0
+		h.probing = false
+		h.lastError = ""
+		if h.inFlight == 0 {
+			delete(l.hosts, host)
+		}
+		return
+	}
+
+	h.failures++
+	h.lastError = errMsg
+
+	switch {
+	case h.state == BreakerHalfOpen:
+		h.cooldown = min(h.cooldown*2, l.MaxCooldown)
+	case h.state == BreakerClosed && l.FailureThreshold > 0 && h.failures >= l.FailureThreshold:
+		h.cooldown = l.Cooldown
+	default:
+		return
+	}
+
+	h.state = BreakerOpen
+	h.openUntil = now.Add(h.cooldown)
+	h.probing = false
+
+	log.Warn().
+		Str("host", host).
+		Int("failures", h.failures).
+		Time("open_until", h.openUntil).
+		Str("last_error", errMsg).
+		Msg("Opened circuit to merchant host")
+}
+
+// Status returns the hosts with deliveries in flight or recent failures
+func (l *HostLimiter) Status() []HostStatus {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := make([]HostStatus, 0, len(l.hosts))
+	for host, h := range l.hosts {
+		s := HostStatus{
+			Host:      host,
+			State:     h.state,
+			InFlight:  h.inFlight,
+			Failures:  h.failures,
+			LastError: h.lastError,
+		}
+		if h.state == BreakerOpen {
+			openUntil := h.openUntil
+			s.OpenUntil = &openUntil
+		}
+		status = append(status, s)
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Host < status[j].Host
+	})
+	return status
+}
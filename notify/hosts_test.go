@@ -0,0 +1,170 @@
+package notify
+
+import (
+	"testing"
+	"time"
+)
+
+const testHost = "shop.example.com"
+
+func TestHostLimiterTrip(t *testing.T) {
+	l := NewHostLimiter(0, 3, time.Minute, 10*time.Minute)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	fail := func() {
+		t.Helper()
+		if _, ok := l.Acquire(testHost, now); !ok {
+			t.Fatal("Acquire() refused a closed circuit")
+		}
+		l.Release(testHost, "timeout", now)
+	}
+
+	fail()
+	fail()
+	if s := l.Status(); len(s) != 1 || s[0].State != BreakerClosed || s[0].Failures != 2 {
+		t.Fatalf("Status() after 2 failures = %+v", s)
+	}
+
+	// A success in between starts the count over
+	if _, ok := l.Acquire(testHost, now); !ok {
+		t.Fatal("Acquire() refused a closed circuit")
+	}
+	l.Release(testHost, "", now)
+	if s := l.Status(); len(s) != 0 {
+		t.Fatalf("Status() after a success = %+v, want the host forgotten", s)
+	}
+
+	fail()
+	fail()
+	fail()
+	s := l.Status()
+	if len(s) != 1 || s[0].State != BreakerOpen || s[0].OpenUntil == nil || !s[0].OpenUntil.Equal(now.Add(time.Minute)) || s[0].LastError != "timeout" {
+		t.Fatalf("Status() after 3 failures = %+v", s)
+	}
+
+	wait, ok := l.Acquire(testHost, now.Add(20*time.Second))
+	if ok || wait != 40*time.Second {
+		t.Errorf("Acquire() of an open circuit = %v, %v, want to wait 40s", wait, ok)
+	}
+	if _, ok := l.Acquire("other.example.com", now); !ok {
+		t.Error("Acquire() refused another host")
+	}
+}
+
+func TestHostLimiterProbe(t *testing.T) {
+	l := NewHostLimiter(0, 1, time.Minute, 3*time.Minute)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	l.Acquire(testHost, now)
+	l.Release(testHost, "timeout", now)
+
+	// Once the cooldown is over, a single delivery probes the host
+	now = now.Add(time.Minute)
+	if _, ok := l.Acquire(testHost, now); !ok {
+		t.Fatal("Acquire() refused the probe")
+	}
+	if s := l.Status(); s[0].State != BreakerHalfOpen || s[0].InFlight != 1 {
+		t.Fatalf("Status() while probing = %+v", s)
+	}
+	for i := 0; i < 3; i++ {
+		if wait, ok := l.Acquire(testHost, now); ok || wait != probeRetryDelay {
+			t.Fatalf("Acquire() during the probe = %v, %v, want to wait %v", wait, ok, probeRetryDelay)
+		}
+	}
+
+	// A failed probe doubles the cooldown, up to MaxCooldown
+	for _, cooldown := range []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		l.Release(testHost, "connection refused", now)
+		s := l.Status()
+		if s[0].State != BreakerOpen || !s[0].OpenUntil.Equal(now.Add(cooldown)) {
+			t.Fatalf("Status() after a failed probe = %+v, want open for %v", s, cooldown)
+		}
+		if _, ok := l.Acquire(testHost, now.Add(cooldown-time.Second)); ok {
+			t.Fatalf("Acquire() before the %v cooldown is over succeeded", cooldown)
+		}
+
+		now = now.Add(cooldown)
+		if _, ok := l.Acquire(testHost, now); !ok {
+			t.Fatalf("Acquire() refused the probe after %v", cooldown)
+		}
+	}
+
+	// A successful probe closes the circuit
+	l.Release(testHost, "", now)
+	if s := l.Status(); len(s) != 0 {
+		t.Fatalf("Status() after a successful probe = %+v", s)
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := l.Acquire(testHost, now); !ok {
+			t.Fatal("Acquire() refused a recovered host")
+		}
+	}
+}
+
+func TestHostLimiterRetrip(t *testing.T) {
+	l := NewHostLimiter(0, 2, time.Minute, time.Hour)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	trip := func() {
+		t.Helper()
+		for i := 0; i < 2; i++ {
+			if _, ok := l.Acquire(testHost, now); !ok {
+				t.Fatal("Acquire() refused a closed circuit")
+			}
+			l.Release(testHost, "timeout", now)
+		}
+	}
+
+	trip()
+	now = now.Add(time.Minute)
+	l.Acquire(testHost, now)
+	l.Release(testHost, "timeout", now)
+	now = now.Add(2 * time.Minute)
+	l.Acquire(testHost, now)
+	l.Release(testHost, "", now)
+
+	// After recovering, the threshold and the first cooldown apply again
+	trip()
+	s := l.Status()
+	if len(s) != 1 || s[0].State != BreakerOpen || !s[0].OpenUntil.Equal(now.Add(time.Minute)) {
+		t.Errorf("Status() after tripping again = %+v, want open for 1m", s)
+	}
+}
+
+func TestHostLimiterMaxInFlight(t *testing.T) {
+	l := NewHostLimiter(2, 1, time.Minute, time.Hour)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	l.Acquire(testHost, now)
+	l.Acquire(testHost, now)
+	if wait, ok := l.Acquire(testHost, now); ok || wait != busyRetryDelay {
+		t.Fatalf("Acquire() over the cap = %v, %v, want to wait %v", wait, ok, busyRetryDelay)
+	}
+
+	// One of them fails and opens the circuit while the other is in flight
+	l.Release(testHost, "timeout", now)
+	now = now.Add(time.Minute)
+	if _, ok := l.Acquire(testHost, now); !ok {
+		t.Fatal("Acquire() refused the probe")
+	}
+	if wait, ok := l.Acquire(testHost, now); ok || wait != probeRetryDelay {
+		t.Errorf("Acquire() during the probe = %v, %v", wait, ok)
+	}
+
+	l.Release(testHost, "", now)
+	l.Release(testHost, "", now)
+	if s := l.Status(); len(s) != 0 {
+		t.Errorf("Status() after both deliveries = %+v", s)
+	}
+}
+
+func TestHostLimiterNil(t *testing.T) {
+	var l *HostLimiter
+	if _, ok := l.Acquire(testHost, time.Now()); !ok {
+		t.Error("nil HostLimiter refused a delivery")
+	}
+	l.Release(testHost, "timeout", time.Now())
+	if s := l.Status(); s != nil {
+		t.Errorf("Status() of a nil HostLimiter = %+v", s)
+	}
+}
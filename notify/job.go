@@ -0,0 +1,98 @@
+package notify
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type JobState string
+
+const (
+	JobPending    JobState = "pending"     // waiting for its next attempt
+	JobDelivered  JobState = "delivered"   // acknowledged by the merchant
+	JobDeadLetter JobState = "dead_letter" // retry schedule used up, only resent by an operator
+)
+
+// Attempt records one delivery attempt of a Job
+type Attempt struct {
+	At        time.Time `json:"at"`
+	Method    string    `json:"method,omitempty"`
+	URL       string    `json:"url,omitempty"`    // request URL with the sign redacted
+	Status    int       `json:"status,omitempty"` // HTTP status, 0 when no response was received
+	Body      string    `json:"body,omitempty"`   // start of the merchant's response body
+	LatencyMs int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Job is an epay notification to be delivered to a merchant
+type Job struct {
+	ID          string     `json:"id"`
+	Pid         int        `json:"pid"`
+	TradeNo     string     `json:"trade_no"`
+	OutTradeNo  string     `json:"out_trade_no"`
+	TradeStatus string     `json:"trade_status,omitempty"` // one job per trade and status, see TransitionID
+	NotifyID    string     `json:"notify_id,omitempty"`    // Alipay notify_id that created the job
+	Env         string     `json:"env,omitempty"`          // environment the order was created in
+	NotifyUrl   string     `json:"notify_url"`
+	Version     int        `json:"version,omitempty"` // epay protocol version of the order, 0 or 1 for V1
+	Params      url.Values `json:"params"`            // epay notify parameters, signed for each attempt by the dispatcher
+	State       JobState   `json:"state"`
+	Attempts    []Attempt  `json:"attempts"`
+	NextAt      time.Time  `json:"next_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// URL returns the notify_url carrying the parameters, as delivered in a GET
+func (job *Job) URL() (string, error) {
+	notifyURL, err := url.Parse(job.NotifyUrl)
+	if err != nil {
+		return "", fmt.Errorf("invalid notify url: %w", err)
+	}
+	notifyURL.RawQuery = job.Params.Encode()
+	return notifyURL.String(), nil
+}
+
+// RedactedURL is URL with the sign replaced, safe to log and show
+func (job *Job) RedactedURL() string {
+	notifyURL, err := url.Parse(job.NotifyUrl)
+	if err != nil {
+		return job.NotifyUrl
+	}
+
+	params := make(url.Values, len(job.Params))
+	for k, v := range job.Params {
+		params[k] = v
+	}
+	if params.Has("sign") {
+		params.Set("sign", "REDACTED")
+	}
+	notifyURL.RawQuery = params.Encode()
+	return notifyURL.String()
+}
+
+// newJobID returns a unique, roughly time ordered job ID
+func newJobID() string {
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(buf)
+}
+
+// TransitionID returns the job ID of a trade reaching a status. Alipay repeats
+// its notifications, and they all map to the same job, so that the merchant
+// hears of each state change once.
+func TransitionID(tradeNo, tradeStatus string) string {
+	clean := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r == '_' {
+				return r
+			}
+			return '-'
+		}, s)
+	}
+	return "trade-" + clean(tradeNo) + "-" + clean(tradeStatus)
+}
@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yiffyi/epay-fwd/alert"
+)
+
+type outcome struct {
+	at    time.Time
+	ok    bool
+	order alert.Order // the job as of the attempt
+}
+
+// FailureMonitor watches the delivery attempts of every merchant over a
+// sliding window, and raises an alert when most of them fail. A merchant is
+// alerted at most once per window.
+type FailureMonitor struct {
+	Window      time.Duration
+	MinAttempts int     // attempts needed in the window before the rate means anything
+	Threshold   float64 // failure rate that raises the alert, 0 to 1
+
+	mu        sync.Mutex
+	outcomes  map[int][]outcome
+	alertedAt map[int]time.Time
+}
+
+func NewFailureMonitor(window time.Duration, minAttempts int, threshold float64) *FailureMonitor {
+	return &FailureMonitor{
+		Window:      window,
+		MinAttempts: minAttempts,
+		Threshold:   threshold,
+		outcomes:    make(map[int][]outcome),
+		alertedAt:   make(map[int]time.Time),
+	}
+}
+
+// Record adds an attempt of the job, and returns the alert to raise if the
+// merchant's failure rate crossed the threshold
+func (m *FailureMonitor) Record(job *Job, attempt Attempt) *alert.Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := attempt.At
+	cutoff := now.Add(-m.Window)
+
+	kept := m.outcomes[job.Pid][:0]
+	for _, o := range m.outcomes[job.Pid] {
+		if o.at.After(cutoff) {
+			kept = append(kept, o)
+		}
+	}
+	kept = append(kept, outcome{at: now, ok: attempt.Error == "", order: jobOrder(job)})
+	m.outcomes[job.Pid] = kept
+
+	failures := 0
+	for _, o := range kept {
+		if !o.ok {
+			failures++
+		}
+	}
+
+	rate := float64(failures) / float64(len(kept))
+	if len(kept) < m.MinAttempts || rate < m.Threshold {
+		return nil
+	}
+	if at, ok := m.alertedAt[job.Pid]; ok && at.After(cutoff) {
+		return nil
+	}
+	m.alertedAt[job.Pid] = now
+
+	// Summarize each failing order once, with its latest attempt
+	var orders []alert.Order
+	seen := make(map[string]int)
+	for _, o := range kept {
+		if o.ok {
+			continue
+		}
+		if i, ok := seen[o.order.JobID]; ok {
+			orders[i] = o.order
+			continue
+		}
+		seen[o.order.JobID] = len(orders)
+		orders = append(orders, o.order)
+	}
+
+	return &alert.Event{
+		Kind:    alert.KindFailureRate,
+		Pid:     job.Pid,
+		Summary: fmt.Sprintf("Merchant %d failed %d of %d notifications in the last %s", job.Pid, failures, len(kept), m.Window),
+		Orders:  orders,
+		At:      now,
+	}
+}
+
+// jobOrder describes a job for an alert
+func jobOrder(job *Job) alert.Order {
+	order := alert.Order{
+		TradeNo:    job.TradeNo,
+		OutTradeNo: job.OutTradeNo,
+		JobID:      job.ID,
+		Attempts:   len(job.Attempts),
+	}
+	if n := len(job.Attempts); n > 0 {
+		order.LastError = job.Attempts[n-1].Error
+	}
+	return order
+}
+
+// deadLetterEvent is the alert raised when a job is dead-lettered
+func deadLetterEvent(job *Job) *alert.Event {
+	return &alert.Event{
+		Kind:    alert.KindDeadLetter,
+		Pid:     job.Pid,
+		Summary: fmt.Sprintf("Notification of order %s to merchant %d was dead-lettered after %d attempts", job.OutTradeNo, job.Pid, len(job.Attempts)),
+		Orders:  []alert.Order{jobOrder(job)},
+	}
+}
@@ -0,0 +1,84 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yiffyi/epay-fwd/alert"
+)
+
+func TestFailureMonitorThreshold(t *testing.T) {
+	m := NewFailureMonitor(10*time.Minute, 4, 0.5)
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	job := &Job{ID: "job-1", Pid: 1001, TradeNo: "T1", OutTradeNo: "O1"}
+	record := func(after time.Duration, ok bool) *alert.Event {
+		attempt := Attempt{At: start.Add(after)}
+		if !ok {
+			attempt.Error = "merchant did not acknowledge the notification"
+		}
+		job.Attempts = append(job.Attempts, attempt)
+		return m.Record(job, attempt)
+	}
+
+	// Three failures are too few attempts to mean anything
+	for i := 0; i < 3; i++ {
+		if evt := record(time.Duration(i)*time.Minute, false); evt != nil {
+			t.Fatalf("alert after %d attempts: %s", i+1, evt.Summary)
+		}
+	}
+
+	evt := record(3*time.Minute, true)
+	if evt == nil {
+		t.Fatal("no alert at 3 failures of 4 attempts")
+	}
+	if evt.Kind != alert.KindFailureRate || evt.Pid != 1001 {
+		t.Errorf("alert kind %s pid %d, want %s pid 1001", evt.Kind, evt.Pid, alert.KindFailureRate)
+	}
+	// The failing job is listed once, with its latest failure
+	if len(evt.Orders) != 1 || evt.Orders[0].JobID != "job-1" || evt.Orders[0].Attempts != 3 {
+		t.Errorf("alert orders = %+v, want job-1 once after 3 attempts", evt.Orders)
+	}
+
+	// Alerted once per window
+	if evt := record(4*time.Minute, false); evt != nil {
+		t.Errorf("second alert in the same window: %s", evt.Summary)
+	}
+
+	// Once the window has moved on, the early failures no longer count
+	for i := 0; i < 3; i++ {
+		if evt := record(time.Duration(20+i)*time.Minute, false); evt != nil {
+			t.Fatalf("alert with %d attempts in the new window: %s", i+1, evt.Summary)
+		}
+	}
+	if evt := record(23*time.Minute, false); evt == nil {
+		t.Error("no alert in the new window")
+	}
+}
+
+func TestFailureMonitorBelowThreshold(t *testing.T) {
+	m := NewFailureMonitor(10*time.Minute, 4, 0.5)
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	job := &Job{ID: "job-1", Pid: 1001}
+	other := &Job{ID: "job-2", Pid: 1002}
+
+	// One failure in four stays below 50%
+	outcomes := []bool{false, true, true, true, true}
+	for i, ok := range outcomes {
+		attempt := Attempt{At: start.Add(time.Duration(i) * time.Minute)}
+		if !ok {
+			attempt.Error = "timeout"
+		}
+		if evt := m.Record(job, attempt); evt != nil {
+			t.Fatalf("alert below the threshold: %s", evt.Summary)
+		}
+	}
+
+	// Merchants are watched separately
+	for i := 0; i < 3; i++ {
+		if evt := m.Record(other, Attempt{At: start.Add(time.Duration(i) * time.Minute), Error: "timeout"}); evt != nil {
+			t.Fatalf("alert for merchant 1002 after %d attempts: %s", i+1, evt.Summary)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"github.com/yiffyi/epay-fwd/alert"
+	"github.com/yiffyi/epay-fwd/misc"
+	"github.com/yiffyi/epay-fwd/outbound"
+)
+
+var dispatcher *Dispatcher
+
+// SetupDispatcher creates the notify dispatcher from the configuration and
+// starts it, keeping jobs in store and signing them with sign for every attempt
+func SetupDispatcher(store Store, sign func(job *Job) (url.Values, error)) error {
+	var schedule []time.Duration
+	for _, s := range viper.GetStringSlice("notify.retry_schedule") {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		schedule = append(schedule, d)
+	}
+
+	client, err := outbound.NewClient(outbound.ConfigFromViper())
+	if err != nil {
+		return err
+	}
+
+	d := NewDispatcher(store, client, schedule, viper.GetInt("notify.workers"))
+	d.Sign = sign
+	d.Hosts = NewHostLimiter(
+		viper.GetInt("notify.max_per_host"),
+		viper.GetInt("notify.breaker.failures"),
+		viper.GetDuration("notify.breaker.cooldown"),
+		viper.GetDuration("notify.breaker.max_cooldown"),
+	)
+	d.Merchant = func(pid int) MerchantOptions {
+		opts := MerchantOptions{
+			Ack:  viper.GetString(misc.MerchantConfigKey(pid, "notify_ack")),
+			Mode: DeliveryMode(strings.ToLower(viper.GetString(misc.MerchantConfigKey(pid, "notify_mode")))),
+		}
+
+		allowed, err := outbound.ParsePrefixes(viper.GetStringSlice(misc.MerchantConfigKey(pid, "notify_allow")))
+		if err != nil {
+			log.Error().Err(err).Int("pid", pid).Msg("Invalid notify_allow of merchant")
+		}
+		opts.Allowed = allowed
+		return opts
+	}
+
+	monitor := NewFailureMonitor(
+		viper.GetDuration("alert.failure_rate.window"),
+		viper.GetInt("alert.failure_rate.min_attempts"),
+		viper.GetFloat64("alert.failure_rate.threshold"),
+	)
+	d.OnAttempt = func(job *Job, attempt Attempt) {
+		if job.State == JobDeadLetter {
+			alert.Fire(deadLetterEvent(job))
+		}
+		if evt := monitor.Record(job, attempt); evt != nil {
+			alert.Fire(evt)
+		}
+	}
+
+	if err := d.Start(); err != nil {
+		return err
+	}
+
+	dispatcher = d
+	return nil
+}
+
+// Enqueue hands a job to the dispatcher set up by SetupDispatcher
+func Enqueue(job *Job) error {
+	if dispatcher == nil {
+		return errors.New("notify dispatcher is not set up")
+	}
+	return dispatcher.Enqueue(job)
+}
+
+// Get returns a job from the store of the dispatcher set up by SetupDispatcher
+func Get(id string) (*Job, error) {
+	if dispatcher == nil {
+		return nil, errors.New("notify dispatcher is not set up")
+	}
+	return dispatcher.Get(id)
+}
+
+// Undelivered lists undelivered jobs of the dispatcher set up by SetupDispatcher
+func Undelivered(from, to time.Time) ([]*Job, error) {
+	if dispatcher == nil {
+		return nil, errors.New("notify dispatcher is not set up")
+	}
+	return dispatcher.Undelivered(from, to)
+}
+
+// History queries the jobs of the dispatcher set up by SetupDispatcher
+func History(filter JobFilter) ([]*Job, error) {
+	if dispatcher == nil {
+		return nil, errors.New("notify dispatcher is not set up")
+	}
+	return dispatcher.History(filter)
+}
+
+// Hosts returns the merchant host states of the dispatcher set up by SetupDispatcher
+func Hosts() []HostStatus {
+	if dispatcher == nil {
+		return nil
+	}
+	return dispatcher.Hosts.Status()
+}
@@ -0,0 +1,36 @@
+package notify
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrJobExists   = errors.New("job already exists")
+	ErrJobNotFound = errors.New("job not found")
+)
+
+// Store persists notify jobs, so that accepted notifications survive restarts
+type Store interface {
+	// Create saves a new job, or fails with ErrJobExists if its ID is taken
+	Create(job *Job) error
+	// Save creates or updates a job
+	Save(job *Job) error
+	// Get returns the job with the ID, or ErrJobNotFound
+	Get(id string) (*Job, error)
+	// Pending returns the jobs still waiting for delivery
+	Pending() ([]*Job, error)
+	// Query returns the jobs matching the filter, newest first
+	Query(filter JobFilter) ([]*Job, error)
+}
+
+// JobFilter selects jobs to query. Zero fields match everything.
+type JobFilter struct {
+	Pid         int
+	TradeNo     string
+	OutTradeNo  string
+	States      []JobState
+	CreatedFrom time.Time // created at or after
+	CreatedTo   time.Time // created before
+	Limit       int
+}
@@ -0,0 +1,125 @@
+package outbound
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Config describes the client used to reach merchant supplied URLs
+type Config struct {
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration // waiting for the response headers after the request is sent
+	Timeout        time.Duration // the whole exchange, including reading the body
+	Proxy          string        // egress proxy URL, direct connections if empty. It must block internal destinations itself, see checkHost.
+	MaxRedirects   int           // 0 returns redirects as they are
+
+	TLSInsecureSkipVerify bool
+	TLSCAFile             string // PEM bundle trusted in addition to the system roots
+	TLSMinVersion         string // "1.0" to "1.3"
+}
+
+// ConfigFromViper reads the outbound.* configuration
+func ConfigFromViper() Config {
+	return Config{
+		ConnectTimeout:        viper.GetDuration("outbound.connect_timeout"),
+		ReadTimeout:           viper.GetDuration("outbound.read_timeout"),
+		Timeout:               viper.GetDuration("outbound.timeout"),
+		Proxy:                 viper.GetString("outbound.proxy"),
+		MaxRedirects:          viper.GetInt("outbound.max_redirects"),
+		TLSInsecureSkipVerify: viper.GetBool("outbound.tls.insecure_skip_verify"),
+		TLSCAFile:             viper.GetString("outbound.tls.ca_file"),
+		TLSMinVersion:         viper.GetString("outbound.tls.min_version"),
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewClient creates a client that refuses to connect to anything but public
+// addresses, except for those allowed in the request context with WithAllowed
+func NewClient(cfg Config) (*http.Client, error) {
+	minVersion, ok := tlsVersions[cfg.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported tls min_version %q", cfg.TLSMinVersion)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         minVersion,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+	}
+	if cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls ca_file: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in tls ca_file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.ReadTimeout,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+
+		// The proxy itself is usually internal, so only the destination is checked
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if err := checkHost(req.Context(), req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			return proxyURL, nil
+		}
+	} else {
+		dialer.ControlContext = controlDial
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   cfg.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.MaxRedirects {
+				return http.ErrUseLastResponse
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}, nil
+}
@@ -0,0 +1,157 @@
+package outbound
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, maxRedirects int) *http.Client {
+	t.Helper()
+
+	client, err := NewClient(Config{
+		ConnectTimeout: time.Second,
+		ReadTimeout:    time.Second,
+		Timeout:        5 * time.Second,
+		MaxRedirects:   maxRedirects,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	return client
+}
+
+func newTestRequest(t *testing.T, target string, allowed ...string) *http.Request {
+	t.Helper()
+
+	prefixes, err := ParsePrefixes(allowed)
+	if err != nil {
+		t.Fatalf("ParsePrefixes() error = %v", err)
+	}
+	req, err := http.NewRequestWithContext(WithAllowed(t.Context(), prefixes), http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	return req
+}
+
+func TestClientBlocksInternal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("success"))
+	}))
+	defer server.Close()
+	client := newTestClient(t, 0)
+
+	_, err := client.Do(newTestRequest(t, server.URL))
+	var blocked *ErrBlockedAddress
+	if !errors.As(err, &blocked) || blocked.Addr != netip.MustParseAddr("127.0.0.1") {
+		t.Fatalf("Do() error = %v, want ErrBlockedAddress", err)
+	}
+
+	resp, err := client.Do(newTestRequest(t, server.URL, "127.0.0.1"))
+	if err != nil {
+		t.Fatalf("Do() of an allowed address error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Do() status = %d", resp.StatusCode)
+	}
+}
+
+func TestClientProxyChecksHost(t *testing.T) {
+	proxied := false
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = true
+		w.Write([]byte("success"))
+	}))
+	defer proxy.Close()
+
+	client, err := NewClient(Config{Timeout: 5 * time.Second, Proxy: proxy.URL})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	// The proxy itself is internal, only the destination counts
+	_, err = client.Do(newTestRequest(t, "http://127.0.0.1:1/notify"))
+	var blocked *ErrBlockedAddress
+	if !errors.As(err, &blocked) || proxied {
+		t.Fatalf("Do() of an internal destination error = %v, proxied %v", err, proxied)
+	}
+
+	resp, err := client.Do(newTestRequest(t, "http://8.8.8.8/notify"))
+	if err != nil {
+		t.Fatalf("Do() of a public destination error = %v", err)
+	}
+	resp.Body.Close()
+	if !proxied {
+		t.Error("Do() did not go through the proxy")
+	}
+}
+
+func TestClientRedirects(t *testing.T) {
+	var target *httptest.Server
+	target = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/once":
+			http.Redirect(w, r, "/done", http.StatusFound)
+		case "/twice":
+			http.Redirect(w, r, "/once", http.StatusFound)
+		case "/ftp":
+			http.Redirect(w, r, "ftp://"+r.Host+"/done", http.StatusFound)
+		case "/internal":
+			u, _ := url.Parse(target.URL)
+			http.Redirect(w, r, "http://127.0.0.2:"+u.Port()+"/done", http.StatusFound)
+		default:
+			w.Write([]byte("success"))
+		}
+	}))
+	defer target.Close()
+
+	tests := []struct {
+		name         string
+		maxRedirects int
+		path         string
+		wantStatus   int
+		wantErr      string
+	}{
+		{"not followed", 0, "/once", http.StatusFound, ""},
+		{"followed", 1, "/once", http.StatusOK, ""},
+		{"too many", 1, "/twice", http.StatusFound, ""},
+		{"all followed", 2, "/twice", http.StatusOK, ""},
+		{"unsupported scheme", 1, "/ftp", 0, "unsupported scheme"},
+		{"to an internal address", 1, "/internal", 0, "not a public address"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := newTestClient(t, tt.maxRedirects).Do(newTestRequest(t, target.URL+tt.path, "127.0.0.1"))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Do() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("Do() status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestNewClientConfig(t *testing.T) {
+	if _, err := NewClient(Config{TLSMinVersion: "1.4"}); err == nil {
+		t.Error("NewClient() accepted tls min_version 1.4")
+	}
+	if _, err := NewClient(Config{TLSCAFile: "/nonexistent/ca.pem"}); err == nil {
+		t.Error("NewClient() accepted a missing tls ca_file")
+	}
+}
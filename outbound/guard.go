@@ -0,0 +1,153 @@
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// blockedPrefixes are special-purpose ranges the netip predicates do not
+// cover but that never lead to a public host
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this network", reaches the host itself on Linux
+	netip.MustParsePrefix("100.64.0.0/10"),  // RFC 6598 shared address space, Alibaba Cloud's metadata server among others
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking, used for internal networks
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, and the broadcast address
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("100::/64"),       // discard-only
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+}
+
+var (
+	// nat64Prefix is the well-known NAT64 prefix, the IPv4 address is in the last 32 bits
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+	// sixToFourPrefix is 6to4, the IPv4 address follows the 16 bit prefix
+	sixToFourPrefix = netip.MustParsePrefix("2002::/16")
+)
+
+// ErrBlockedAddress is returned when a request would reach an internal address
+type ErrBlockedAddress struct {
+	Addr netip.Addr
+}
+
+func (e *ErrBlockedAddress) Error() string {
+	return fmt.Sprintf("destination %s is not a public address", e.Addr)
+}
+
+// IsPublic reports whether addr is a publicly routable unicast address. NAT64
+// and 6to4 addresses are public only if the IPv4 address they carry is.
+func IsPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() ||
+		addr.IsUnspecified() ||
+		addr.IsLoopback() ||
+		addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() {
+		return false
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+
+	b := addr.As16()
+	switch {
+	case nat64Prefix.Contains(addr):
+		return IsPublic(netip.AddrFrom4([4]byte(b[12:16])))
+	case sixToFourPrefix.Contains(addr):
+		return IsPublic(netip.AddrFrom4([4]byte(b[2:6])))
+	}
+	return true
+}
+
+type allowedKey struct{}
+
+// WithAllowed returns a context under which requests may also reach the given
+// prefixes, even if they are not public
+func WithAllowed(ctx context.Context, allowed []netip.Prefix) context.Context {
+	if len(allowed) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, allowedKey{}, allowed)
+}
+
+// ParsePrefixes parses IP addresses and CIDR prefixes
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// checkAddr allows public addresses and those allowed in ctx
+func checkAddr(ctx context.Context, addr netip.Addr) error {
+	addr = addr.Unmap()
+	if IsPublic(addr) {
+		return nil
+	}
+
+	allowed, _ := ctx.Value(allowedKey{}).([]netip.Prefix)
+	for _, p := range allowed {
+		if p.Contains(addr) {
+			return nil
+		}
+	}
+	return &ErrBlockedAddress{Addr: addr}
+}
+
+// controlDial checks the address about to be connected to, which is known
+// only after DNS resolution, so that a name cannot resolve to a blocked address
+func controlDial(ctx context.Context, network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("unexpected dial address %q: %w", address, err)
+	}
+	return checkAddr(ctx, ap.Addr())
+}
+
+// checkHost checks every address host resolves to. It is used when requests
+// go through a proxy, which does its own resolution, so the check cannot be
+// made at dial time.
+//
+// The proxy resolves the name again, and a name answering differently the
+// second time (DNS rebinding) gets through. Only the proxy can close that
+// gap, it must refuse internal destinations itself.
+func checkHost(ctx context.Context, host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return checkAddr(ctx, addr)
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err := checkAddr(ctx, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
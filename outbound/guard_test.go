@@ -0,0 +1,120 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"203.119.1.1", true},
+		{"2400:3200::1", true},
+		{"::ffff:8.8.8.8", true},
+
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.100.100.200", false},
+		{"192.0.0.8", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"::", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		{"2001:db8::1", false},
+		{"100::1", false},
+		{"64:ff9b:1::a00:1", false},
+
+		// NAT64 and 6to4 are as public as the IPv4 address they carry
+		{"64:ff9b::808:808", true},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"2002:808:808::1", true},
+		{"2002:7f00:1::1", false},
+		{"2002:a00:1::1", false},
+		{"2002:6464:64c8::1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := IsPublic(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("IsPublic(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestControlDial(t *testing.T) {
+	allowed, err := ParsePrefixes([]string{"127.0.0.1", " 10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatalf("ParsePrefixes() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		address string
+		wantErr bool
+	}{
+		{"public", context.Background(), "8.8.8.8:443", false},
+		{"public v6", context.Background(), "[2400:3200::1]:443", false},
+		{"loopback", context.Background(), "127.0.0.1:80", true},
+		{"mapped loopback", context.Background(), "[::ffff:127.0.0.1]:80", true},
+		{"metadata", context.Background(), "100.100.100.200:80", true},
+		{"nat64 loopback", context.Background(), "[64:ff9b::7f00:1]:80", true},
+		{"allowed address", WithAllowed(context.Background(), allowed), "127.0.0.1:80", false},
+		{"allowed prefix", WithAllowed(context.Background(), allowed), "10.2.3.4:80", false},
+		{"allowed v6 prefix", WithAllowed(context.Background(), allowed), "[fd12::1]:80", false},
+		{"outside allowed", WithAllowed(context.Background(), allowed), "127.0.0.2:80", true},
+		{"not an address", context.Background(), "localhost:80", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := controlDial(tt.ctx, "tcp", tt.address, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("controlDial(%s) error = %v, want error %v", tt.address, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckHostLiteral(t *testing.T) {
+	var blocked *ErrBlockedAddress
+	if err := checkHost(context.Background(), "127.0.0.1"); !errors.As(err, &blocked) {
+		t.Errorf("checkHost(127.0.0.1) error = %v, want ErrBlockedAddress", err)
+	}
+	if err := checkHost(context.Background(), "8.8.8.8"); err != nil {
+		t.Errorf("checkHost(8.8.8.8) error = %v", err)
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	if _, err := ParsePrefixes([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("ParsePrefixes() accepted an invalid prefix")
+	}
+	if _, err := ParsePrefixes([]string{"example.com"}); err == nil {
+		t.Error("ParsePrefixes() accepted a host name")
+	}
+
+	prefixes, err := ParsePrefixes([]string{"10.1.2.3/8"})
+	if err != nil || len(prefixes) != 1 || prefixes[0].String() != "10.0.0.0/8" {
+		t.Errorf("ParsePrefixes() = %v, %v", prefixes, err)
+	}
+}
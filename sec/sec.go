@@ -5,6 +5,8 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
+	"strings"
 )
 
 func DeriveMyEpayKey(pid int, fwdSecret string) string {
@@ -20,3 +22,38 @@ func DeriveMyEpayKey(pid int, fwdSecret string) string {
 	// Return as URL-safe base64
 	return base64.RawURLEncoding.EncodeToString(hash)
 }
+
+// VerifyMyEpayKey reports whether key is the epay key derived for pid, in constant time
+func VerifyMyEpayKey(pid int, key string, fwdSecret string) bool {
+	return hmac.Equal([]byte(DeriveMyEpayKey(pid, fwdSecret)), []byte(key))
+}
+
+// SignToken appends an HMAC of payload to it, so that data handed to a third
+// party (e.g. in a URL) can be trusted when it comes back. purpose separates
+// tokens made for different uses.
+func SignToken(purpose string, payload string, secret string) string {
+	return payload + "." + tokenMAC(purpose, payload, secret)
+}
+
+// OpenToken verifies a token made by SignToken and returns its payload
+func OpenToken(purpose string, token string, secret string) (string, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return "", errors.New("malformed token")
+	}
+
+	payload, mac := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(tokenMAC(purpose, payload, secret)), []byte(mac)) {
+		return "", errors.New("invalid token signature")
+	}
+
+	return payload, nil
+}
+
+func tokenMAC(purpose string, payload string, secret string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(purpose))
+	h.Write([]byte{0})
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
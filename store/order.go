@@ -0,0 +1,140 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/yiffyi/epay-fwd/notify"
+)
+
+var (
+	ErrOrderExists       = errors.New("order already exists")
+	ErrOrderNotFound     = errors.New("order not found")
+	ErrInvalidTransition = errors.New("order cannot change to this status")
+)
+
+type OrderStatus string
+
+const (
+	OrderCreated  OrderStatus = "created"  // submitted, waiting for the buyer
+	OrderPaid     OrderStatus = "paid"     // paid at Alipay
+	OrderClosed   OrderStatus = "closed"   // closed without payment
+	OrderRefunded OrderStatus = "refunded" // partly or fully refunded after payment
+
+	// OrderQuarantined holds an order whose Alipay trade does not match the
+	// submit, such as a different amount. It is not forwarded until reviewed.
+	OrderQuarantined OrderStatus = "quarantined"
+)
+
+// orderTransitions lists the statuses an order may change to. Paid, refunded
+// and closed orders never become payable or paid again, however late Alipay
+// repeats itself. Quarantined orders are only released by an operator.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderCreated:  {OrderPaid, OrderClosed, OrderQuarantined},
+	OrderPaid:     {OrderRefunded, OrderQuarantined},
+	OrderRefunded: {OrderQuarantined},
+	OrderClosed:   {OrderQuarantined},
+}
+
+// canTransition tells whether an order may change from one status to another
+func canTransition(from, to OrderStatus, release bool) bool {
+	if from == to {
+		return true
+	}
+	if from == OrderQuarantined {
+		return release && to == OrderPaid
+	}
+	return slices.Contains(orderTransitions[from], to)
+}
+
+// Order is an epay order forwarded to Alipay, identified by the merchant's
+// pid and out_trade_no, or by our globally unique trade_no
+type Order struct {
+	ID               int64       `json:"id"`
+	Pid              int         `json:"pid"`
+	OutTradeNo       string      `json:"out_trade_no"`
+	TradeNo          string      `json:"trade_no,omitempty"`     // our number, the out_trade_no at Alipay; empty for old orders
+	ApiTradeNo       string      `json:"api_trade_no,omitempty"` // Alipay trade_no, known once Alipay reports on the order
+	Env              string      `json:"env"`
+	Type             string      `json:"type"`
+	Name             string      `json:"name"`
+	Money            string      `json:"money"`
+	NotifyUrl        string      `json:"notify_url"`
+	ReturnUrl        string      `json:"return_url,omitempty"`
+	Param            string      `json:"param,omitempty"`
+	PayMethod        string      `json:"pay_method"`
+	PayUrl           string      `json:"pay_url,omitempty"` // payment created at Alipay, handed out again on resubmission
+	QRCode           string      `json:"qrcode,omitempty"`
+	Version          int         `json:"version"` // epay protocol version of the submit
+	SignType         string      `json:"sign_type"`
+	Status           OrderStatus `json:"status"`
+	Buyer            string      `json:"buyer,omitempty"`
+	RefundMoney      string      `json:"refund_money,omitempty"`      // total refunded so far
+	QuarantineReason string      `json:"quarantine_reason,omitempty"` // what did not match, for quarantined orders
+	CreatedAt        time.Time   `json:"created_at"`
+	UpdatedAt        time.Time   `json:"updated_at"`
+	PaidAt           time.Time   `json:"paid_at"`    // zero until paid
+	ExpiresAt        time.Time   `json:"expires_at"` // when the buyer runs out of time to pay, zero for Alipay's default
+}
+
+// OrderUpdate is a change of an order, such as reported by Alipay. Empty
+// fields are left as they are.
+type OrderUpdate struct {
+	Status           OrderStatus
+	PayMethod        string
+	PayUrl           string
+	QRCode           string
+	ApiTradeNo       string
+	Buyer            string
+	RefundMoney      string
+	PaidAt           time.Time
+	QuarantineReason string // set along with OrderQuarantined
+	Release          bool   // an operator releasing a quarantined order as paid
+	Source           string // what reported the change, such as alipay_notify
+	Detail           string // such as the Alipay notify_id
+}
+
+// OrderFilter selects orders to list. Zero fields match everything.
+type OrderFilter struct {
+	Pid           int
+	Status        OrderStatus
+	ExpiredBefore time.Time // only orders expiring at or before, listed soonest expired first
+	ExcludeIDs    []int64
+	Limit         int
+}
+
+// Transition records an order changing its status
+type Transition struct {
+	OrderID int64
+	From    OrderStatus // empty for the creation of the order
+	To      OrderStatus
+	Source  string
+	Detail  string
+	At      time.Time
+}
+
+// OrderStore persists orders with their status history, and the notify jobs
+// and attempts telling merchants about them
+type OrderStore interface {
+	notify.Store
+
+	// CreateOrder saves a new order, or fails with ErrOrderExists
+	CreateOrder(ctx context.Context, order *Order) error
+	// GetOrder returns an order by merchant and out_trade_no, or ErrOrderNotFound
+	GetOrder(ctx context.Context, pid int, outTradeNo string) (*Order, error)
+	// GetOrderByTradeNo returns an order by our trade_no, or ErrOrderNotFound
+	GetOrderByTradeNo(ctx context.Context, tradeNo string) (*Order, error)
+	// UpdateOrder applies a change to an order and records the transition if
+	// its status changed. A status change the order cannot make fails with
+	// ErrInvalidTransition, and nothing is changed.
+	UpdateOrder(ctx context.Context, pid int, outTradeNo string, update OrderUpdate) (*Order, error)
+	// ListOrders returns the orders matching the filter, newest first unless
+	// filtered by expiry
+	ListOrders(ctx context.Context, filter OrderFilter) ([]*Order, error)
+	// Transitions returns the status history of an order, oldest first
+	Transitions(ctx context.Context, orderID int64) ([]Transition, error)
+
+	Close() error
+}
@@ -0,0 +1,26 @@
+package store
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+var orders OrderStore
+
+// Setup opens the order store configured by store.path
+func Setup() error {
+	path := viper.GetString("store.path")
+	s, err := OpenSQLite(path)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("path", path).Msg("Order store opened")
+	orders = s
+	return nil
+}
+
+// Orders returns the store opened by Setup
+func Orders() OrderStore {
+	return orders
+}
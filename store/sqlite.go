@@ -0,0 +1,200 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order, the version of a database is kept in its
+// user_version. Never edit a released migration, append a new one.
+var migrations = []string{
+	`CREATE TABLE orders (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		pid          INTEGER NOT NULL,
+		out_trade_no TEXT    NOT NULL,
+		trade_no     TEXT    NOT NULL DEFAULT '',
+		env          TEXT    NOT NULL,
+		type         TEXT    NOT NULL,
+		name         TEXT    NOT NULL,
+		money        TEXT    NOT NULL,
+		notify_url   TEXT    NOT NULL,
+		return_url   TEXT    NOT NULL DEFAULT '',
+		param        TEXT    NOT NULL DEFAULT '',
+		pay_method   TEXT    NOT NULL,
+		version      INTEGER NOT NULL,
+		sign_type    TEXT    NOT NULL DEFAULT '',
+		status       TEXT    NOT NULL,
+		buyer        TEXT    NOT NULL DEFAULT '',
+		refund_money TEXT    NOT NULL DEFAULT '',
+		created_at   TEXT    NOT NULL,
+		updated_at   TEXT    NOT NULL,
+		paid_at      TEXT    NOT NULL DEFAULT '',
+		UNIQUE (pid, out_trade_no)
+	);
+	CREATE INDEX orders_trade_no ON orders (trade_no);
+
+	CREATE TABLE order_transitions (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		order_id    INTEGER NOT NULL REFERENCES orders (id),
+		from_status TEXT    NOT NULL,
+		to_status   TEXT    NOT NULL,
+		source      TEXT    NOT NULL,
+		detail      TEXT    NOT NULL DEFAULT '',
+		at          TEXT    NOT NULL
+	);
+	CREATE INDEX order_transitions_order ON order_transitions (order_id);
+
+	CREATE TABLE notify_jobs (
+		id           TEXT    PRIMARY KEY,
+		pid          INTEGER NOT NULL,
+		trade_no     TEXT    NOT NULL,
+		out_trade_no TEXT    NOT NULL,
+		trade_status TEXT    NOT NULL DEFAULT '',
+		notify_id    TEXT    NOT NULL DEFAULT '',
+		env          TEXT    NOT NULL DEFAULT '',
+		notify_url   TEXT    NOT NULL,
+		params       TEXT    NOT NULL,
+		state        TEXT    NOT NULL,
+		next_at      TEXT    NOT NULL,
+		created_at   TEXT    NOT NULL,
+		updated_at   TEXT    NOT NULL
+	);
+	CREATE INDEX notify_jobs_state ON notify_jobs (state);
+	CREATE INDEX notify_jobs_order ON notify_jobs (pid, out_trade_no);
+
+	CREATE TABLE notify_attempts (
+		job_id     TEXT    NOT NULL REFERENCES notify_jobs (id),
+		seq        INTEGER NOT NULL,
+		at         TEXT    NOT NULL,
+		method     TEXT    NOT NULL DEFAULT '',
+		url        TEXT    NOT NULL DEFAULT '',
+		status     INTEGER NOT NULL DEFAULT 0,
+		body       TEXT    NOT NULL DEFAULT '',
+		latency_ms INTEGER NOT NULL DEFAULT 0,
+		error      TEXT    NOT NULL DEFAULT '',
+		PRIMARY KEY (job_id, seq)
+	);`,
+	`ALTER TABLE orders ADD COLUMN quarantine_reason TEXT NOT NULL DEFAULT '';
+	CREATE INDEX orders_status ON orders (status);`,
+	// trade_no becomes our number, which Alipay knows as out_trade_no. Orders
+	// from before have none, Alipay knows them by the merchant's out_trade_no.
+	`ALTER TABLE orders RENAME COLUMN trade_no TO api_trade_no;
+	DROP INDEX orders_trade_no;
+	CREATE INDEX orders_api_trade_no ON orders (api_trade_no);
+	ALTER TABLE orders ADD COLUMN trade_no TEXT;
+	CREATE UNIQUE INDEX orders_trade_no ON orders (trade_no);`,
+	`ALTER TABLE orders ADD COLUMN pay_url TEXT NOT NULL DEFAULT '';
+	ALTER TABLE orders ADD COLUMN qrcode TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE orders ADD COLUMN expires_at TEXT NOT NULL DEFAULT '';
+	CREATE INDEX orders_expires_at ON orders (status, expires_at);`,
+	// Jobs are signed for every attempt, V2 ones with a fresh timestamp. Only
+	// V2 notifications carried a timestamp before.
+	`ALTER TABLE notify_jobs ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
+	UPDATE notify_jobs SET version = 2 WHERE json_extract(params, '$.timestamp') IS NOT NULL;`,
+	// Notify history is queried by merchant, trade and creation time
+	`CREATE INDEX notify_jobs_trade_no ON notify_jobs (trade_no);
+	CREATE INDEX notify_jobs_pid_created ON notify_jobs (pid, created_at);
+	CREATE INDEX notify_jobs_created ON notify_jobs (created_at);`,
+	// Times used to drop trailing zeros of their fraction, which broke
+	// comparing them as text
+	fixedWidthTimes("orders", "created_at", "updated_at", "paid_at", "expires_at") +
+		fixedWidthTimes("order_transitions", "at") +
+		fixedWidthTimes("notify_jobs", "next_at", "created_at", "updated_at") +
+		fixedWidthTimes("notify_attempts", "at"),
+}
+
+// fixedWidthTimes returns the statement rewriting RFC 3339 times in UTC, as
+// formatted with time.RFC3339Nano, in the columns of table to timeLayout
+func fixedWidthTimes(table string, columns ...string) string {
+	set := make([]string, 0, len(columns))
+	for _, c := range columns {
+		set = append(set, fmt.Sprintf(`%[1]s = CASE
+			WHEN %[1]s = '' THEN ''
+			WHEN instr(%[1]s, '.') = 0 THEN substr(%[1]s, 1, 19) || '.000000000Z'
+			ELSE substr(%[1]s, 1, 20) || substr(substr(%[1]s, 21, length(%[1]s) - 21) || '000000000', 1, 9) || 'Z'
+		END`, c))
+	}
+	return fmt.Sprintf("UPDATE %s SET %s;\n", table, strings.Join(set, ", "))
+}
+
+// SQLiteStore is an OrderStore in an embedded SQLite database
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens or creates the database at path and migrates it to the
+// current schema
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// SQLite has a single writer, queueing here beats SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLiteStore) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this build", version)
+	}
+
+	for v := version; v < len(migrations); v++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[v]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to migrate database to version %d: %w", v+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", v+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Info().Int("version", v+1).Msg("Migrated database")
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// timeLayout is RFC 3339 with a fixed width fraction. Times are kept in UTC
+// in it, so that comparing them as text compares the times.
+const timeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(timeLayout)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
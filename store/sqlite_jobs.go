@@ -0,0 +1,237 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/yiffyi/epay-fwd/notify"
+)
+
+const jobColumns = `id, pid, trade_no, out_trade_no, trade_status, notify_id, env, notify_url, version, params, state, next_at, created_at, updated_at`
+
+func (s *SQLiteStore) Create(job *notify.Job) error {
+	params, err := json.Marshal(job.Params)
+	if err != nil {
+		return fmt.Errorf("failed to encode job params: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO notify_jobs (`+jobColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`,
+		job.ID, job.Pid, job.TradeNo, job.OutTradeNo, job.TradeStatus, job.NotifyID, job.Env, job.NotifyUrl, job.Version, string(params),
+		job.State, formatTime(job.NextAt), formatTime(job.CreatedAt), formatTime(job.UpdatedAt))
+	if err != nil {
+		return fmt.Errorf("failed to create job: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return notify.ErrJobExists
+	}
+
+	if err := insertAttempts(tx, job); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Save updates the job; attempts are only ever appended
+func (s *SQLiteStore) Save(job *notify.Job) error {
+	params, err := json.Marshal(job.Params)
+	if err != nil {
+		return fmt.Errorf("failed to encode job params: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO notify_jobs (`+jobColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET params = excluded.params, state = excluded.state,
+			next_at = excluded.next_at, updated_at = excluded.updated_at`,
+		job.ID, job.Pid, job.TradeNo, job.OutTradeNo, job.TradeStatus, job.NotifyID, job.Env, job.NotifyUrl, job.Version, string(params),
+		job.State, formatTime(job.NextAt), formatTime(job.CreatedAt), formatTime(job.UpdatedAt)); err != nil {
+		return fmt.Errorf("failed to save job: %w", err)
+	}
+
+	if err := insertAttempts(tx, job); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertAttempts(tx *sql.Tx, job *notify.Job) error {
+	for i, a := range job.Attempts {
+		if _, err := tx.Exec(`INSERT INTO notify_attempts (job_id, seq, at, method, url, status, body, latency_ms, error)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (job_id, seq) DO NOTHING`,
+			job.ID, i, formatTime(a.At), a.Method, a.URL, a.Status, a.Body, a.LatencyMs, a.Error); err != nil {
+			return fmt.Errorf("failed to save job attempt: %w", err)
+		}
+	}
+	return nil
+}
+
+// attemptBatch bounds the job IDs per attempt query, well below SQLite's
+// limit on variables
+const attemptBatch = 500
+
+func (s *SQLiteStore) Get(id string) (*notify.Job, error) {
+	jobs, err := s.queryJobs(`WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, notify.ErrJobNotFound
+	}
+	return jobs[0], nil
+}
+
+func (s *SQLiteStore) Pending() ([]*notify.Job, error) {
+	return s.queryJobs(`WHERE state = ? ORDER BY created_at`, notify.JobPending)
+}
+
+func (s *SQLiteStore) Query(filter notify.JobFilter) ([]*notify.Job, error) {
+	var where []string
+	var args []any
+	if filter.Pid != 0 {
+		where = append(where, "pid = ?")
+		args = append(args, filter.Pid)
+	}
+	if filter.TradeNo != "" {
+		where = append(where, "trade_no = ?")
+		args = append(args, filter.TradeNo)
+	}
+	if filter.OutTradeNo != "" {
+		where = append(where, "out_trade_no = ?")
+		args = append(args, filter.OutTradeNo)
+	}
+	if len(filter.States) > 0 {
+		where = append(where, "state IN ("+placeholders(len(filter.States))+")")
+		for _, state := range filter.States {
+			args = append(args, state)
+		}
+	}
+	if !filter.CreatedFrom.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, formatTime(filter.CreatedFrom))
+	}
+	if !filter.CreatedTo.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, formatTime(filter.CreatedTo))
+	}
+
+	var query string
+	if len(where) > 0 {
+		query = "WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	return s.queryJobs(query, args...)
+}
+
+// queryJobs loads the jobs selected by the rest of the query, with their attempts
+func (s *SQLiteStore) queryJobs(rest string, args ...any) ([]*notify.Job, error) {
+	ctx := context.Background()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+jobColumns+` FROM notify_jobs `+rest, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*notify.Job
+	for rows.Next() {
+		var job notify.Job
+		var params, nextAt, createdAt, updatedAt string
+		if err := rows.Scan(&job.ID, &job.Pid, &job.TradeNo, &job.OutTradeNo, &job.TradeStatus, &job.NotifyID, &job.Env,
+			&job.NotifyUrl, &job.Version, &params, &job.State, &nextAt, &createdAt, &updatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read job: %w", err)
+		}
+		if err := json.Unmarshal([]byte(params), &job.Params); err != nil {
+			return nil, fmt.Errorf("failed to decode params of job %s: %w", job.ID, err)
+		}
+		if job.NextAt, err = parseTime(nextAt); err != nil {
+			return nil, err
+		}
+		if job.CreatedAt, err = parseTime(createdAt); err != nil {
+			return nil, err
+		}
+		if job.UpdatedAt, err = parseTime(updatedAt); err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, &job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.loadAttempts(ctx, jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// loadAttempts fills in the attempts of jobs, a batch of jobs per query
+func (s *SQLiteStore) loadAttempts(ctx context.Context, jobs []*notify.Job) error {
+	for start := 0; start < len(jobs); start += attemptBatch {
+		batch := jobs[start:min(start+attemptBatch, len(jobs))]
+
+		byID := make(map[string]*notify.Job, len(batch))
+		ids := make([]any, 0, len(batch))
+		for _, job := range batch {
+			byID[job.ID] = job
+			ids = append(ids, job.ID)
+		}
+
+		rows, err := s.db.QueryContext(ctx, `SELECT job_id, at, method, url, status, body, latency_ms, error
+			FROM notify_attempts WHERE job_id IN (`+placeholders(len(ids))+`) ORDER BY job_id, seq`, ids...)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var jobID, at string
+			var a notify.Attempt
+			if err := rows.Scan(&jobID, &at, &a.Method, &a.URL, &a.Status, &a.Body, &a.LatencyMs, &a.Error); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to read job attempt: %w", err)
+			}
+			if a.At, err = parseTime(at); err != nil {
+				rows.Close()
+				return err
+			}
+			if job, ok := byID[jobID]; ok {
+				job.Attempts = append(job.Attempts, a)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// placeholders returns n comma separated query placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// ensure SQLiteStore can back the notify dispatcher
+var _ notify.Store = (*SQLiteStore)(nil)
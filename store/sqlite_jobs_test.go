@@ -0,0 +1,240 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/yiffyi/epay-fwd/notify"
+)
+
+// newTestJob returns a job of a trade reaching status, created at
+func newTestJob(tradeNo, status string, state notify.JobState, createdAt time.Time) *notify.Job {
+	return &notify.Job{
+		ID:          notify.TransitionID(tradeNo, status) + "-" + createdAt.Format("150405.000"),
+		Pid:         1001,
+		TradeNo:     tradeNo,
+		OutTradeNo:  "O" + tradeNo,
+		TradeStatus: status,
+		NotifyUrl:   "https://shop.example.com/notify.php",
+		Params:      url.Values{"trade_no": {tradeNo}, "trade_status": {status}},
+		State:       state,
+		NextAt:      createdAt,
+		CreatedAt:   createdAt,
+		UpdatedAt:   createdAt,
+	}
+}
+
+func TestCreateJobUnique(t *testing.T) {
+	s := openTestStore(t)
+	now := time.Now()
+
+	job := newTestJob("T1", "TRADE_SUCCESS", notify.JobPending, now)
+	job.ID = notify.TransitionID("T1", "TRADE_SUCCESS")
+	job.Version = 2
+	if err := s.Create(job); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	again := newTestJob("T1", "TRADE_SUCCESS", notify.JobPending, now.Add(time.Second))
+	again.ID = job.ID
+	again.Params.Set("trade_status", "changed")
+	if err := s.Create(again); !errors.Is(err, notify.ErrJobExists) {
+		t.Fatalf("Create() of a taken ID error = %v, want ErrJobExists", err)
+	}
+
+	stored, err := s.Get(job.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if stored.Params.Get("trade_status") != "TRADE_SUCCESS" || stored.Version != 2 || !stored.CreatedAt.Equal(job.CreatedAt) {
+		t.Errorf("Create() of a taken ID changed the job to %+v", stored)
+	}
+
+	if _, err := s.Get("missing"); !errors.Is(err, notify.ErrJobNotFound) {
+		t.Errorf("Get() of a missing job error = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestSaveJobAppendsAttempts(t *testing.T) {
+	s := openTestStore(t)
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	job := newTestJob("T1", "TRADE_SUCCESS", notify.JobPending, start)
+	if err := s.Create(job); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	job.Attempts = append(job.Attempts, notify.Attempt{At: start, Status: 500, LatencyMs: 12, Error: "merchant did not acknowledge the notification"})
+	job.NextAt = start.Add(time.Minute)
+	if err := s.Save(job); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	job.Attempts = append(job.Attempts, notify.Attempt{At: start.Add(time.Minute), Status: 200, Body: "success", LatencyMs: 34})
+	job.State = notify.JobDelivered
+	if err := s.Save(job); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	stored, err := s.Get(job.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if stored.State != notify.JobDelivered || len(stored.Attempts) != 2 {
+		t.Fatalf("saved job is %s with %d attempts", stored.State, len(stored.Attempts))
+	}
+	if a := stored.Attempts[1]; a.Status != 200 || a.Body != "success" || a.LatencyMs != 34 || !a.At.Equal(start.Add(time.Minute)) {
+		t.Errorf("second attempt = %+v", a)
+	}
+
+	pending, err := s.Pending()
+	if err != nil {
+		t.Fatalf("Pending() error = %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Pending() = %d jobs after delivery", len(pending))
+	}
+}
+
+func TestQueryJobs(t *testing.T) {
+	s := openTestStore(t)
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	jobs := []*notify.Job{
+		newTestJob("T1", "TRADE_SUCCESS", notify.JobDelivered, start),
+		newTestJob("T2", "TRADE_SUCCESS", notify.JobPending, start.Add(500*time.Millisecond)),
+		newTestJob("T3", "TRADE_SUCCESS", notify.JobDeadLetter, start.Add(time.Second)),
+		newTestJob("T1", "TRADE_REFUND", notify.JobPending, start.Add(2*time.Second)),
+	}
+	jobs[2].Pid = 1002
+	for _, job := range jobs {
+		job.Attempts = []notify.Attempt{{At: job.CreatedAt, Error: "timeout"}}
+		if err := s.Create(job); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter notify.JobFilter
+		want   []int // indexes into jobs, newest first
+	}{
+		{"all", notify.JobFilter{}, []int{3, 2, 1, 0}},
+		{"merchant", notify.JobFilter{Pid: 1002}, []int{2}},
+		{"trade", notify.JobFilter{TradeNo: "T1"}, []int{3, 0}},
+		{"out_trade_no", notify.JobFilter{OutTradeNo: "OT2"}, []int{1}},
+		{"states", notify.JobFilter{States: []notify.JobState{notify.JobPending, notify.JobDeadLetter}}, []int{3, 2, 1}},
+		{"limit", notify.JobFilter{Limit: 2}, []int{3, 2}},
+		// Within a second, the trailing zeros of the fraction matter
+		{"created from", notify.JobFilter{CreatedFrom: start.Add(500 * time.Millisecond)}, []int{3, 2, 1}},
+		{"created to", notify.JobFilter{CreatedTo: start.Add(500 * time.Millisecond)}, []int{0}},
+		{"created in", notify.JobFilter{CreatedFrom: start, CreatedTo: start.Add(time.Second)}, []int{1, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Query(tt.filter)
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+
+			var gotIDs, wantIDs []string
+			for _, job := range got {
+				gotIDs = append(gotIDs, job.ID)
+				if len(job.Attempts) != 1 {
+					t.Errorf("job %s has %d attempts", job.ID, len(job.Attempts))
+				}
+			}
+			for _, i := range tt.want {
+				wantIDs = append(wantIDs, jobs[i].ID)
+			}
+			if fmt.Sprint(gotIDs) != fmt.Sprint(wantIDs) {
+				t.Errorf("Query() = %v, want %v", gotIDs, wantIDs)
+			}
+		})
+	}
+
+	pending, err := s.Pending()
+	if err != nil {
+		t.Fatalf("Pending() error = %v", err)
+	}
+	if len(pending) != 2 || pending[0].ID != jobs[1].ID || pending[1].ID != jobs[3].ID {
+		t.Errorf("Pending() is not the pending jobs oldest first")
+	}
+}
+
+func TestQueryJobsAttemptBatches(t *testing.T) {
+	s := openTestStore(t)
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	n := attemptBatch + 10
+	for i := 0; i < n; i++ {
+		job := newTestJob(fmt.Sprintf("T%d", i), "TRADE_SUCCESS", notify.JobDelivered, start.Add(time.Duration(i)*time.Second))
+		job.Attempts = []notify.Attempt{{At: job.CreatedAt, Status: 200, Body: "success"}}
+		if err := s.Create(job); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+	}
+
+	jobs, err := s.Query(notify.JobFilter{})
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if len(jobs) != n {
+		t.Fatalf("Query() = %d jobs, want %d", len(jobs), n)
+	}
+	for _, job := range jobs {
+		if len(job.Attempts) != 1 {
+			t.Fatalf("job %s has %d attempts", job.ID, len(job.Attempts))
+		}
+	}
+}
+
+func TestUndelivered(t *testing.T) {
+	s := openTestStore(t)
+	d := notify.NewDispatcher(s, http.DefaultClient, nil, 1)
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	refund := func(job *notify.Job, outRefundNo string) *notify.Job {
+		job.ID += "-" + outRefundNo
+		job.Params.Set("out_refund_no", outRefundNo)
+		return job
+	}
+
+	jobs := []*notify.Job{
+		// Dead-lettered, then resent and delivered
+		newTestJob("T1", "TRADE_SUCCESS", notify.JobDeadLetter, start),
+		newTestJob("T1", "TRADE_SUCCESS", notify.JobDelivered, start.Add(time.Minute)),
+		// Dead-lettered, then resent and dead-lettered again
+		newTestJob("T2", "TRADE_SUCCESS", notify.JobDeadLetter, start.Add(2*time.Minute)),
+		newTestJob("T2", "TRADE_SUCCESS", notify.JobDeadLetter, start.Add(3*time.Minute)),
+		// Two refunds of a trade, only one delivered
+		refund(newTestJob("T3", "TRADE_REFUND", notify.JobDelivered, start.Add(4*time.Minute)), "R1"),
+		refund(newTestJob("T3", "TRADE_REFUND", notify.JobPending, start.Add(5*time.Minute)), "R2"),
+		// Outside of the range
+		newTestJob("T4", "TRADE_SUCCESS", notify.JobDeadLetter, start.Add(time.Hour)),
+	}
+	for _, job := range jobs {
+		if err := s.Create(job); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+	}
+
+	undelivered, err := d.Undelivered(start, start.Add(10*time.Minute))
+	if err != nil {
+		t.Fatalf("Undelivered() error = %v", err)
+	}
+
+	var got []string
+	for _, job := range undelivered {
+		got = append(got, job.ID)
+	}
+	want := []string{jobs[5].ID, jobs[3].ID}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Undelivered() = %v, want %v", got, want)
+	}
+}
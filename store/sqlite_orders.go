@@ -0,0 +1,251 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const orderColumns = `id, pid, out_trade_no, COALESCE(trade_no, ''), api_trade_no, env, type, name, money, notify_url, return_url,
+	param, pay_method, pay_url, qrcode, version, sign_type, status, buyer, refund_money, quarantine_reason, created_at, updated_at, paid_at, expires_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanOrder(row rowScanner) (*Order, error) {
+	var o Order
+	var createdAt, updatedAt, paidAt, expiresAt string
+	err := row.Scan(&o.ID, &o.Pid, &o.OutTradeNo, &o.TradeNo, &o.ApiTradeNo, &o.Env, &o.Type, &o.Name, &o.Money, &o.NotifyUrl, &o.ReturnUrl,
+		&o.Param, &o.PayMethod, &o.PayUrl, &o.QRCode, &o.Version, &o.SignType, &o.Status, &o.Buyer, &o.RefundMoney, &o.QuarantineReason, &createdAt, &updatedAt, &paidAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOrderNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read order: %w", err)
+	}
+
+	if o.CreatedAt, err = parseTime(createdAt); err != nil {
+		return nil, err
+	}
+	if o.UpdatedAt, err = parseTime(updatedAt); err != nil {
+		return nil, err
+	}
+	if o.PaidAt, err = parseTime(paidAt); err != nil {
+		return nil, err
+	}
+	if o.ExpiresAt, err = parseTime(expiresAt); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (s *SQLiteStore) CreateOrder(ctx context.Context, order *Order) error {
+	now := time.Now()
+	if order.Status == "" {
+		order.Status = OrderCreated
+	}
+	order.CreatedAt = now
+	order.UpdatedAt = now
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `INSERT INTO orders (pid, out_trade_no, trade_no, api_trade_no, env, type, name, money, notify_url, return_url,
+		param, pay_method, version, sign_type, status, buyer, refund_money, created_at, updated_at, paid_at, expires_at)
+		VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (pid, out_trade_no) DO NOTHING`,
+		order.Pid, order.OutTradeNo, order.TradeNo, order.ApiTradeNo, order.Env, order.Type, order.Name, order.Money, order.NotifyUrl, order.ReturnUrl,
+		order.Param, order.PayMethod, order.Version, order.SignType, order.Status, order.Buyer, order.RefundMoney,
+		formatTime(order.CreatedAt), formatTime(order.UpdatedAt), formatTime(order.PaidAt), formatTime(order.ExpiresAt))
+	if err != nil {
+		return fmt.Errorf("failed to create order: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrOrderExists
+	}
+
+	if order.ID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	if err := insertTransition(ctx, tx, Transition{
+		OrderID: order.ID,
+		To:      order.Status,
+		Source:  "submit",
+		At:      now,
+	}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetOrder(ctx context.Context, pid int, outTradeNo string) (*Order, error) {
+	return scanOrder(s.db.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM orders WHERE pid = ? AND out_trade_no = ?`, pid, outTradeNo))
+}
+
+func (s *SQLiteStore) GetOrderByTradeNo(ctx context.Context, tradeNo string) (*Order, error) {
+	if tradeNo == "" {
+		return nil, ErrOrderNotFound
+	}
+	return scanOrder(s.db.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM orders WHERE trade_no = ?`, tradeNo))
+}
+
+func (s *SQLiteStore) UpdateOrder(ctx context.Context, pid int, outTradeNo string, update OrderUpdate) (*Order, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	order, err := scanOrder(tx.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM orders WHERE pid = ? AND out_trade_no = ?`, pid, outTradeNo))
+	if err != nil {
+		return nil, err
+	}
+
+	from := order.Status
+	if update.Status != "" && !canTransition(from, update.Status, update.Release) {
+		return nil, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, update.Status)
+	}
+	if update.Status != "" {
+		order.Status = update.Status
+	}
+	if update.PayMethod != "" {
+		order.PayMethod = update.PayMethod
+	}
+	if update.PayUrl != "" || update.QRCode != "" {
+		order.PayUrl = update.PayUrl
+		order.QRCode = update.QRCode
+	}
+	if update.ApiTradeNo != "" {
+		order.ApiTradeNo = update.ApiTradeNo
+	}
+	if update.Buyer != "" {
+		order.Buyer = update.Buyer
+	}
+	if update.RefundMoney != "" {
+		order.RefundMoney = update.RefundMoney
+	}
+	if update.QuarantineReason != "" {
+		order.QuarantineReason = update.QuarantineReason
+	}
+	if !update.PaidAt.IsZero() && order.PaidAt.IsZero() {
+		order.PaidAt = update.PaidAt
+	}
+	order.UpdatedAt = time.Now()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = ?, pay_method = ?, pay_url = ?, qrcode = ?, api_trade_no = ?, buyer = ?,
+		refund_money = ?, quarantine_reason = ?, paid_at = ?, updated_at = ? WHERE id = ?`,
+		order.Status, order.PayMethod, order.PayUrl, order.QRCode, order.ApiTradeNo, order.Buyer, order.RefundMoney, order.QuarantineReason, formatTime(order.PaidAt), formatTime(order.UpdatedAt), order.ID); err != nil {
+		return nil, fmt.Errorf("failed to update order: %w", err)
+	}
+
+	if order.Status != from {
+		if err := insertTransition(ctx, tx, Transition{
+			OrderID: order.ID,
+			From:    from,
+			To:      order.Status,
+			Source:  update.Source,
+			Detail:  update.Detail,
+			At:      order.UpdatedAt,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (s *SQLiteStore) ListOrders(ctx context.Context, filter OrderFilter) ([]*Order, error) {
+	var where []string
+	var args []any
+	if filter.Pid != 0 {
+		where = append(where, "pid = ?")
+		args = append(args, filter.Pid)
+	}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if !filter.ExpiredBefore.IsZero() {
+		where = append(where, "expires_at != '' AND expires_at <= ?")
+		args = append(args, formatTime(filter.ExpiredBefore))
+	}
+	if len(filter.ExcludeIDs) > 0 {
+		where = append(where, "id NOT IN (?"+strings.Repeat(", ?", len(filter.ExcludeIDs)-1)+")")
+		for _, id := range filter.ExcludeIDs {
+			args = append(args, id)
+		}
+	}
+
+	query := `SELECT ` + orderColumns + ` FROM orders`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if filter.ExpiredBefore.IsZero() {
+		query += " ORDER BY id DESC"
+	} else {
+		query += " ORDER BY expires_at, id"
+	}
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []*Order
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+func insertTransition(ctx context.Context, tx *sql.Tx, t Transition) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO order_transitions (order_id, from_status, to_status, source, detail, at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		t.OrderID, t.From, t.To, t.Source, t.Detail, formatTime(t.At))
+	if err != nil {
+		return fmt.Errorf("failed to record order transition: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Transitions(ctx context.Context, orderID int64) ([]Transition, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT order_id, from_status, to_status, source, detail, at
+		FROM order_transitions WHERE order_id = ? ORDER BY id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transitions []Transition
+	for rows.Next() {
+		var t Transition
+		var at string
+		if err := rows.Scan(&t.OrderID, &t.From, &t.To, &t.Source, &t.Detail, &at); err != nil {
+			return nil, err
+		}
+		if t.At, err = parseTime(at); err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, t)
+	}
+	return transitions, rows.Err()
+}
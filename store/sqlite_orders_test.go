@@ -0,0 +1,237 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTestOrder returns an order of pid waiting for the buyer
+func newTestOrder(pid int, outTradeNo string) *Order {
+	return &Order{
+		Pid:        pid,
+		OutTradeNo: outTradeNo,
+		TradeNo:    fmt.Sprintf("T%d%s", pid, outTradeNo),
+		Env:        "sandbox",
+		Type:       "alipay",
+		Name:       "VIP",
+		Money:      "1.00",
+		NotifyUrl:  "https://shop.example.com/notify.php",
+		PayMethod:  "page",
+		Version:    1,
+	}
+}
+
+func TestCreateOrderUnique(t *testing.T) {
+	s := openTestStore(t)
+	ctx := t.Context()
+
+	first := newTestOrder(1001, "O1")
+	if err := s.CreateOrder(ctx, first); err != nil {
+		t.Fatalf("CreateOrder() error = %v", err)
+	}
+	if first.ID == 0 || first.Status != OrderCreated || first.CreatedAt.IsZero() {
+		t.Errorf("created order = %+v", first)
+	}
+
+	tests := []struct {
+		name    string
+		order   *Order
+		wantErr error
+		fails   bool
+	}{
+		{"same out_trade_no", newTestOrder(1001, "O1"), ErrOrderExists, true},
+		{"same out_trade_no of another merchant", newTestOrder(1002, "O1"), nil, false},
+		{"same trade_no", &Order{Pid: 1001, OutTradeNo: "O3", TradeNo: first.TradeNo, Env: "sandbox", Type: "alipay",
+			Name: "VIP", Money: "1.00", NotifyUrl: "https://shop.example.com/notify.php", PayMethod: "page"}, nil, true},
+		{"without trade_no", &Order{Pid: 1001, OutTradeNo: "O4", Env: "sandbox", Type: "alipay",
+			Name: "VIP", Money: "1.00", NotifyUrl: "https://shop.example.com/notify.php", PayMethod: "page"}, nil, false},
+		{"without trade_no again", &Order{Pid: 1001, OutTradeNo: "O5", Env: "sandbox", Type: "alipay",
+			Name: "VIP", Money: "1.00", NotifyUrl: "https://shop.example.com/notify.php", PayMethod: "page"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.CreateOrder(ctx, tt.order)
+			if !tt.fails {
+				if err != nil {
+					t.Fatalf("CreateOrder() error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("CreateOrder() succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("CreateOrder() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The first order is untouched
+	stored, err := s.GetOrderByTradeNo(ctx, first.TradeNo)
+	if err != nil {
+		t.Fatalf("GetOrderByTradeNo() error = %v", err)
+	}
+	if stored.ID != first.ID || stored.OutTradeNo != "O1" {
+		t.Errorf("GetOrderByTradeNo() = %+v", stored)
+	}
+	if _, err := s.GetOrderByTradeNo(ctx, ""); !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("GetOrderByTradeNo(\"\") error = %v, want ErrOrderNotFound", err)
+	}
+	if _, err := s.GetOrder(ctx, 1003, "O1"); !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("GetOrder() of another merchant error = %v, want ErrOrderNotFound", err)
+	}
+}
+
+func TestListOrders(t *testing.T) {
+	s := openTestStore(t)
+	ctx := t.Context()
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	orders := []struct {
+		pid       int
+		status    OrderStatus
+		expiresAt time.Time
+	}{
+		{1001, OrderCreated, now.Add(-time.Second)},
+		{1001, OrderCreated, now},                             // expires right now
+		{1001, OrderCreated, now.Add(500 * time.Millisecond)}, // same second, later
+		{1001, OrderCreated, time.Time{}},                     // Alipay's default timeout
+		{1001, OrderPaid, now.Add(-time.Hour)},
+		{1002, OrderCreated, now.Add(-time.Minute)},
+	}
+	var ids []int64
+	for i, o := range orders {
+		order := newTestOrder(o.pid, fmt.Sprintf("O%d", i))
+		order.Status = o.status
+		order.ExpiresAt = o.expiresAt
+		if err := s.CreateOrder(ctx, order); err != nil {
+			t.Fatalf("CreateOrder() error = %v", err)
+		}
+		ids = append(ids, order.ID)
+	}
+
+	tests := []struct {
+		name   string
+		filter OrderFilter
+		want   []string // newest first, soonest expired first when filtered by expiry
+	}{
+		{"all", OrderFilter{}, []string{"O5", "O4", "O3", "O2", "O1", "O0"}},
+		{"merchant", OrderFilter{Pid: 1002}, []string{"O5"}},
+		{"status", OrderFilter{Status: OrderPaid}, []string{"O4"}},
+		{"limit", OrderFilter{Limit: 2}, []string{"O5", "O4"}},
+		{"expired", OrderFilter{Status: OrderCreated, ExpiredBefore: now}, []string{"O5", "O0", "O1"}},
+		{"expired of merchant", OrderFilter{Pid: 1001, Status: OrderCreated, ExpiredBefore: now}, []string{"O0", "O1"}},
+		{"expired within the second", OrderFilter{Status: OrderCreated, ExpiredBefore: now.Add(500 * time.Millisecond)}, []string{"O5", "O0", "O1", "O2"}},
+		{"expired longest ago", OrderFilter{Status: OrderCreated, ExpiredBefore: now, Limit: 2}, []string{"O5", "O0"}},
+		{"excluded", OrderFilter{ExcludeIDs: []int64{ids[5], ids[2]}}, []string{"O4", "O3", "O1", "O0"}},
+		{"expired but excluded", OrderFilter{Status: OrderCreated, ExpiredBefore: now, ExcludeIDs: []int64{ids[5]}, Limit: 2}, []string{"O0", "O1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listed, err := s.ListOrders(ctx, tt.filter)
+			if err != nil {
+				t.Fatalf("ListOrders() error = %v", err)
+			}
+
+			got := make([]string, 0, len(listed))
+			for _, order := range listed {
+				got = append(got, order.OutTradeNo)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("ListOrders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateOrderTransitions(t *testing.T) {
+	all := []OrderStatus{OrderCreated, OrderPaid, OrderClosed, OrderRefunded, OrderQuarantined}
+	allowed := map[[2]OrderStatus]bool{
+		{OrderCreated, OrderPaid}:         true,
+		{OrderCreated, OrderClosed}:       true,
+		{OrderCreated, OrderQuarantined}:  true,
+		{OrderPaid, OrderRefunded}:        true,
+		{OrderPaid, OrderQuarantined}:     true,
+		{OrderRefunded, OrderQuarantined}: true,
+		{OrderClosed, OrderQuarantined}:   true,
+	}
+
+	s := openTestStore(t)
+	ctx := t.Context()
+
+	for _, from := range all {
+		for _, to := range all {
+			t.Run(string(from)+"-"+string(to), func(t *testing.T) {
+				order := newTestOrder(1001, string(from)+"-"+string(to))
+				order.Status = from
+				if err := s.CreateOrder(ctx, order); err != nil {
+					t.Fatalf("CreateOrder() error = %v", err)
+				}
+
+				updated, err := s.UpdateOrder(ctx, order.Pid, order.OutTradeNo, OrderUpdate{
+					Status: to,
+					Buyer:  "buyer@example.com",
+					Source: "test",
+				})
+				if from == to || allowed[[2]OrderStatus{from, to}] {
+					if err != nil {
+						t.Fatalf("UpdateOrder() error = %v", err)
+					}
+					if updated.Status != to || updated.Buyer != "buyer@example.com" {
+						t.Errorf("updated order is %s by %q", updated.Status, updated.Buyer)
+					}
+					return
+				}
+
+				if !errors.Is(err, ErrInvalidTransition) {
+					t.Fatalf("UpdateOrder() error = %v, want ErrInvalidTransition", err)
+				}
+				stored, err := s.GetOrder(ctx, order.Pid, order.OutTradeNo)
+				if err != nil {
+					t.Fatalf("GetOrder() error = %v", err)
+				}
+				if stored.Status != from || stored.Buyer != "" {
+					t.Errorf("refused update changed the order to %s by %q", stored.Status, stored.Buyer)
+				}
+			})
+		}
+	}
+}
+
+func TestUpdateOrderRelease(t *testing.T) {
+	s := openTestStore(t)
+	ctx := t.Context()
+
+	order := newTestOrder(1001, "O1")
+	order.Status = OrderQuarantined
+	if err := s.CreateOrder(ctx, order); err != nil {
+		t.Fatalf("CreateOrder() error = %v", err)
+	}
+
+	if _, err := s.UpdateOrder(ctx, 1001, "O1", OrderUpdate{Status: OrderPaid, Source: "alipay_notify"}); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("quarantined order paid without release, error = %v", err)
+	}
+	if _, err := s.UpdateOrder(ctx, 1001, "O1", OrderUpdate{Status: OrderRefunded, Release: true}); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("quarantined order released as refunded, error = %v", err)
+	}
+
+	released, err := s.UpdateOrder(ctx, 1001, "O1", OrderUpdate{Status: OrderPaid, Release: true, Source: "admin_release"})
+	if err != nil {
+		t.Fatalf("UpdateOrder() error = %v", err)
+	}
+	if released.Status != OrderPaid {
+		t.Errorf("released order is %s", released.Status)
+	}
+
+	transitions, err := s.Transitions(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("Transitions() error = %v", err)
+	}
+	if len(transitions) != 2 || transitions[1].From != OrderQuarantined || transitions[1].To != OrderPaid || transitions[1].Source != "admin_release" {
+		t.Errorf("transitions = %+v", transitions)
+	}
+}
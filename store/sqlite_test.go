@@ -0,0 +1,208 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// openTestStore opens a fresh store in a temporary file
+func openTestStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "epay-fwd.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLite() error = %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// createAtVersion creates a database at path with only the first version
+// migrations applied, as an older build would have left it
+func createAtVersion(t *testing.T, path string, version int) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	for v := 0; v < version; v++ {
+		if _, err := db.Exec(migrations[v]); err != nil {
+			t.Fatalf("failed to apply migration %d: %v", v+1, err)
+		}
+	}
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		t.Fatalf("failed to set user_version: %v", err)
+	}
+	return db
+}
+
+func TestFormatTimeSorts(t *testing.T) {
+	base := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	times := []time.Time{
+		base.Add(time.Second),
+		base.Add(500 * time.Millisecond),
+		base,
+		base.Add(time.Nanosecond),
+		base.Add(-time.Nanosecond),
+		base.In(time.FixedZone("CST", 8*60*60)).Add(10 * time.Millisecond),
+	}
+
+	formatted := make([]string, len(times))
+	for i, tm := range times {
+		formatted[i] = formatTime(tm)
+		if len(formatted[i]) != len(formatTime(base)) {
+			t.Errorf("formatTime(%v) = %s is not fixed width", tm, formatted[i])
+		}
+
+		parsed, err := parseTime(formatted[i])
+		if err != nil || !parsed.Equal(tm) {
+			t.Errorf("parseTime(%s) = %v, %v, want %v", formatted[i], parsed, err, tm)
+		}
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	sort.Strings(formatted)
+	for i := range times {
+		if formatted[i] != formatTime(times[i]) {
+			t.Errorf("text order %v differs from time order at %d", formatted, i)
+			break
+		}
+	}
+
+	if formatTime(time.Time{}) != "" {
+		t.Error("zero time is not formatted empty")
+	}
+}
+
+func TestMigrateRewritesTimes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "epay-fwd.db")
+	db := createAtVersion(t, path, 7)
+
+	// As formatted with time.RFC3339Nano before
+	if _, err := db.Exec(`INSERT INTO orders (pid, out_trade_no, env, type, name, money, notify_url, pay_method, version, status,
+		created_at, updated_at, paid_at, expires_at)
+		VALUES (1001, 'O1', 'sandbox', 'alipay', 'n', '1.00', 'https://shop.example.com/notify', 'page', 1, 'paid',
+		'2024-01-02T03:04:05Z', '2024-01-02T03:04:05.5Z', '', '2024-01-02T03:04:05.123456789Z')`); err != nil {
+		t.Fatalf("failed to insert order: %v", err)
+	}
+	db.Close()
+
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("OpenSQLite() error = %v", err)
+	}
+	defer s.Close()
+
+	var createdAt, updatedAt, paidAt, expiresAt string
+	if err := s.db.QueryRow(`SELECT created_at, updated_at, paid_at, expires_at FROM orders`).Scan(&createdAt, &updatedAt, &paidAt, &expiresAt); err != nil {
+		t.Fatalf("failed to read order: %v", err)
+	}
+
+	want := []string{"2024-01-02T03:04:05.000000000Z", "2024-01-02T03:04:05.500000000Z", "", "2024-01-02T03:04:05.123456789Z"}
+	for i, got := range []string{createdAt, updatedAt, paidAt, expiresAt} {
+		if got != want[i] {
+			t.Errorf("time %d = %q, want %q", i, got, want[i])
+		}
+	}
+
+	order, err := s.GetOrder(t.Context(), 1001, "O1")
+	if err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+	if !order.UpdatedAt.Equal(time.Date(2024, 1, 2, 3, 4, 5, 500_000_000, time.UTC)) {
+		t.Errorf("UpdatedAt = %v", order.UpdatedAt)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	for version := 0; version < len(migrations); version++ {
+		t.Run(fmt.Sprintf("from %d", version), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "epay-fwd.db")
+			db := createAtVersion(t, path, version)
+
+			// Rows an older build left behind, in the columns of the first schema
+			if version > 0 {
+				if _, err := db.Exec(`INSERT INTO orders (pid, out_trade_no, env, type, name, money, notify_url, pay_method, version, status,
+					created_at, updated_at)
+					VALUES (1001, 'O1', 'sandbox', 'alipay', 'VIP', '1.00', 'https://shop.example.com/notify.php', 'page', 2, 'paid',
+					'2024-01-02T03:04:05Z', '2024-01-02T03:04:06Z')`); err != nil {
+					t.Fatalf("failed to insert order: %v", err)
+				}
+				if _, err := db.Exec(`INSERT INTO notify_jobs (id, pid, trade_no, out_trade_no, notify_url, params, state, next_at, created_at, updated_at)
+					VALUES ('job-1', 1001, '2024010203040510011234', 'O1', 'https://shop.example.com/notify.php',
+					'{"out_trade_no":["O1"],"timestamp":["1704164645"]}', 'delivered', '2024-01-02T03:04:05Z', '2024-01-02T03:04:05Z', '2024-01-02T03:04:05Z')`); err != nil {
+					t.Fatalf("failed to insert job: %v", err)
+				}
+				if _, err := db.Exec(`INSERT INTO notify_attempts (job_id, seq, at, status, body) VALUES ('job-1', 0, '2024-01-02T03:04:05.25Z', 200, 'success')`); err != nil {
+					t.Fatalf("failed to insert attempt: %v", err)
+				}
+			}
+			db.Close()
+
+			s, err := OpenSQLite(path)
+			if err != nil {
+				t.Fatalf("OpenSQLite() error = %v", err)
+			}
+			defer s.Close()
+
+			var got int
+			if err := s.db.QueryRow("PRAGMA user_version").Scan(&got); err != nil {
+				t.Fatalf("failed to read user_version: %v", err)
+			}
+			if got != len(migrations) {
+				t.Errorf("user_version = %d, want %d", got, len(migrations))
+			}
+
+			// The current schema works on the migrated database
+			if err := s.CreateOrder(t.Context(), newTestOrder(1002, "O2")); err != nil {
+				t.Errorf("CreateOrder() error = %v", err)
+			}
+			if version == 0 {
+				return
+			}
+
+			order, err := s.GetOrder(t.Context(), 1001, "O1")
+			if err != nil {
+				t.Fatalf("GetOrder() error = %v", err)
+			}
+			if order.Status != OrderPaid || order.TradeNo != "" || !order.ExpiresAt.IsZero() {
+				t.Errorf("migrated order = %+v", order)
+			}
+
+			job, err := s.Get("job-1")
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			// Jobs from before version 6 are V2 if they carry a timestamp
+			wantVersion := 2
+			if version >= 6 {
+				wantVersion = 0
+			}
+			if job.Version != wantVersion || job.Params.Get("out_trade_no") != "O1" {
+				t.Errorf("migrated job has version %d and params %v, want version %d", job.Version, job.Params, wantVersion)
+			}
+			if len(job.Attempts) != 1 || !job.Attempts[0].At.Equal(time.Date(2024, 1, 2, 3, 4, 5, 250_000_000, time.UTC)) {
+				t.Errorf("migrated job attempts = %+v", job.Attempts)
+			}
+		})
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "epay-fwd.db")
+	db := createAtVersion(t, path, 0)
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(migrations)+1)); err != nil {
+		t.Fatalf("failed to set user_version: %v", err)
+	}
+	db.Close()
+
+	if s, err := OpenSQLite(path); err == nil {
+		s.Close()
+		t.Error("OpenSQLite() opened a database of a newer build")
+	}
+}
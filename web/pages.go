@@ -0,0 +1,24 @@
+package web
+
+// QRCodePage is the data of qrcode.html, shown for device=qrcode submits
+type QRCodePage struct {
+	OutTradeNo string
+	Name       string
+	Money      string
+	QRCode     string // content of the Alipay precreate QR code
+}
+
+// PayType is a payment method offered in the cashier
+type PayType struct {
+	Type string // epay type, e.g. alipay
+	Name string // display name
+}
+
+// CashierPage is the data of cashier.html, shown for submits without a type
+type CashierPage struct {
+	OutTradeNo string
+	Name       string
+	Money      string
+	Token      string // signed submission to continue
+	Types      []PayType
+}
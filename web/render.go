@@ -0,0 +1,43 @@
+package web
+
+import (
+	"embed"
+	"encoding/base64"
+	"html/template"
+	"io"
+
+	"github.com/labstack/echo/v4"
+	"github.com/skip2/go-qrcode"
+)
+
+//go:embed templates/*.html
+var templatesFS embed.FS
+
+// Renderer renders the buyer facing pages from the embedded templates
+type Renderer struct {
+	templates *template.Template
+}
+
+func NewRenderer() *Renderer {
+	funcs := template.FuncMap{
+		"qrcode": qrcodeDataURI,
+	}
+
+	return &Renderer{
+		templates: template.Must(template.New("").Funcs(funcs).ParseFS(templatesFS, "templates/*.html")),
+	}
+}
+
+// Render implements echo.Renderer
+func (r *Renderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	return r.templates.ExecuteTemplate(w, name, data)
+}
+
+// qrcodeDataURI encodes content as a QR code PNG data URI for an <img> tag
+func qrcodeDataURI(content string) (template.URL, error) {
+	png, err := qrcode.Encode(content, qrcode.Medium, 256)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}